@@ -1,13 +1,30 @@
 package amqp
 
+import "errors"
+
+var ErrQueueNotFound = errors.New("amqp: Queue not found")
+
+// QueueStats are the counts of a queue at the time it was inspected.
+type QueueStats struct {
+	Name      string
+	Messages  int // ready to be delivered
+	Consumers int
+}
+
 type Admin interface {
 	DeclareExchange(*Exchange) error
 	DeleteExchange(string) error
+	ExchangeExists(string) (bool, error)
 
 	DeclareQueue(*Queue) error
 	DeclareAnonymousQueue() (*Queue, error)
+	QueueExists(string) (bool, error)
+	InspectQueue(string) (*QueueStats, error)
 	DeleteQueue(name string, ifUnused, ifEmpty bool) error
-	PurgeQueue(name string, noWait bool) error
+
+	// PurgeQueue removes the messages ready in the queue and returns how
+	// many there were, or 0 with noWait.
+	PurgeQueue(name string, noWait bool) (int, error)
 
 	DeclareBinding(*Binding) error
 	RemoveBinding(*Binding) error
@@ -3,14 +3,15 @@ package amqp
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"sync"
 
 	"github.com/streadway/amqp"
 )
 
 type amqpAdmin struct {
-	conn *amqp.Connection
-	ch   *amqp.Channel
+	conn Connection
+	ch   Channel
 }
 
 func toAMQPTable(src map[string]interface{}) amqp.Table {
@@ -19,17 +20,62 @@ func toAMQPTable(src map[string]interface{}) amqp.Table {
 	}
 	dest := make(amqp.Table, len(src))
 	for key, val := range src {
-		if table, ok := val.(map[string]interface{}); ok {
-			val = toAMQPTable(table)
+		dest[key] = toAMQPValue(val)
+	}
+	return dest
+}
+
+func toAMQPValue(val interface{}) interface{} {
+	switch val := val.(type) {
+	case map[string]interface{}:
+		return toAMQPTable(val)
+	case []interface{}:
+		dest := make([]interface{}, len(val))
+		for i, v := range val {
+			dest[i] = toAMQPValue(v)
 		}
-		dest[key] = val
+		return dest
+	default:
+		return val
+	}
+}
+
+// ToTable converts a map, including nested maps, to an AMQP field table.
+func ToTable(src map[string]interface{}) amqp.Table {
+	return toAMQPTable(src)
+}
+
+// FromTable converts an AMQP field table, including nested tables, to a
+// map.
+func FromTable(src amqp.Table) map[string]interface{} {
+	if src == nil {
+		return nil
+	}
+	dest := make(map[string]interface{}, len(src))
+	for key, val := range src {
+		dest[key] = fromAMQPValue(val)
 	}
 	return dest
 }
 
+func fromAMQPValue(val interface{}) interface{} {
+	switch val := val.(type) {
+	case amqp.Table:
+		return FromTable(val)
+	case []interface{}:
+		dest := make([]interface{}, len(val))
+		for i, v := range val {
+			dest[i] = fromAMQPValue(v)
+		}
+		return dest
+	default:
+		return val
+	}
+}
+
 func (a *amqpAdmin) maybeOpen() error {
 	if a.ch == nil {
-		ch, err := a.conn.Channel()
+		ch, err := a.conn.CreateChannel()
 		if err != nil {
 			return err
 		}
@@ -67,10 +113,30 @@ func (a *amqpAdmin) DeleteExchange(name string) error {
 	)
 }
 
+// ExchangeExists checks for the exchange with a passive declaration.
+func (a *amqpAdmin) ExchangeExists(name string) (bool, error) {
+	if err := a.maybeOpen(); err != nil {
+		return false, err
+	}
+	err := a.ch.ExchangeDeclarePassive(
+		name,     // name string
+		"direct", // kind string, ignored
+		false,    // durable bool
+		false,    // autoDelete bool
+		false,    // internal bool
+		false,    // noWait bool
+		nil,      // args amqp.Table
+	)
+	return a.exists(err)
+}
+
 func (a *amqpAdmin) DeclareQueue(q *Queue) error {
 	if q == nil {
 		return errors.New("amqp: Queue is nil")
 	}
+	if err := q.Validate(); err != nil {
+		return err
+	}
 	if err := a.maybeOpen(); err != nil {
 		return err
 	}
@@ -109,6 +175,60 @@ func (a *amqpAdmin) DeclareAnonymousQueue() (*Queue, error) {
 	)
 }
 
+// QueueExists checks for the queue with a passive declaration.
+func (a *amqpAdmin) QueueExists(name string) (bool, error) {
+	if err := a.maybeOpen(); err != nil {
+		return false, err
+	}
+	_, err := a.ch.QueueDeclarePassive(
+		name,  // name string
+		false, // durable bool
+		false, // autoDelete bool
+		false, // exclusive bool
+		false, // noWait bool
+		nil,   // args amqp.Table
+	)
+	return a.exists(err)
+}
+
+// InspectQueue gets the counts of the queue with a passive declaration.
+func (a *amqpAdmin) InspectQueue(name string) (*QueueStats, error) {
+	if err := a.maybeOpen(); err != nil {
+		return nil, err
+	}
+	q, err := a.ch.QueueDeclarePassive(
+		name,  // name string
+		false, // durable bool
+		false, // autoDelete bool
+		false, // exclusive bool
+		false, // noWait bool
+		nil,   // args amqp.Table
+	)
+	if exists, err := a.exists(err); err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, ErrQueueNotFound
+	}
+	return &QueueStats{
+		Name:      q.Name,
+		Messages:  q.Messages,
+		Consumers: q.Consumers,
+	}, nil
+}
+
+// exists interprets the result of a passive declaration. The broker closes
+// the channel when the entity doesn't exist, so it is reopened on next use.
+func (a *amqpAdmin) exists(err error) (bool, error) {
+	if err == nil {
+		return true, nil
+	}
+	if amqpErr, ok := err.(*amqp.Error); ok && amqpErr.Code == amqp.NotFound {
+		a.ch = nil
+		return false, nil
+	}
+	return false, err
+}
+
 func (a *amqpAdmin) DeleteQueue(name string, ifUnused, ifEmpty bool) error {
 	if err := a.maybeOpen(); err != nil {
 		return err
@@ -122,15 +242,20 @@ func (a *amqpAdmin) DeleteQueue(name string, ifUnused, ifEmpty bool) error {
 	return err
 }
 
-func (a *amqpAdmin) PurgeQueue(name string, noWait bool) error {
+func (a *amqpAdmin) PurgeQueue(name string, noWait bool) (int, error) {
 	if err := a.maybeOpen(); err != nil {
-		return err
+		return 0, err
 	}
-	_, err := a.ch.QueuePurge(
+	n, err := a.ch.QueuePurge(
 		name,   // name string
 		noWait, // noWait bool
 	)
-	return err
+	if exists, err := a.exists(err); err != nil {
+		return 0, err
+	} else if !exists {
+		return 0, ErrQueueNotFound
+	}
+	return n, nil
 }
 
 func (a *amqpAdmin) DeclareBinding(b *Binding) error {
@@ -197,6 +322,9 @@ func (a *amqpAdmin) RemoveBinding(b *Binding) error {
 }
 
 func (a *amqpAdmin) Close() error {
+	if a.ch == nil {
+		return nil
+	}
 	if err := a.ch.Close(); err != nil {
 		return err
 	}
@@ -204,7 +332,7 @@ func (a *amqpAdmin) Close() error {
 	return nil
 }
 
-func NewAMQPAdmin(conn *amqp.Connection) (Admin, error) {
+func NewAMQPAdmin(conn Connection) (Admin, error) {
 	return &amqpAdmin{
 		conn: conn,
 	}, nil
@@ -212,13 +340,90 @@ func NewAMQPAdmin(conn *amqp.Connection) (Admin, error) {
 
 // Connection
 
+// channelListeners implements the Notify methods of Connection.
+// Notifications are queued, they never block on a listener.
+type channelListeners struct {
+	muNotify              sync.Mutex
+	notifyClosed          bool
+	createChannelNotifies []*notifier
+	closeChannelNotifies  []*notifier
+}
+
+func newChannelNotifier(ch chan Channel) *notifier {
+	return newNotifier(
+		func(v interface{}) { ch <- v.(Channel) },
+		func() { close(ch) },
+	)
+}
+
+func (l *channelListeners) NotifyCreateChannel(ch chan Channel) chan Channel {
+	l.muNotify.Lock()
+	defer l.muNotify.Unlock()
+	if l.notifyClosed {
+		close(ch)
+	} else {
+		l.createChannelNotifies = append(l.createChannelNotifies, newChannelNotifier(ch))
+	}
+	return ch
+}
+
+func (l *channelListeners) NotifyCloseChannel(ch chan Channel) chan Channel {
+	l.muNotify.Lock()
+	defer l.muNotify.Unlock()
+	if l.notifyClosed {
+		close(ch)
+	} else {
+		l.closeChannelNotifies = append(l.closeChannelNotifies, newChannelNotifier(ch))
+	}
+	return ch
+}
+
+func (l *channelListeners) notifyCreateChannel(channel Channel) {
+	l.muNotify.Lock()
+	defer l.muNotify.Unlock()
+	for _, n := range l.createChannelNotifies {
+		n.notify(channel)
+	}
+}
+
+func (l *channelListeners) notifyCloseChannel(channel Channel) {
+	l.muNotify.Lock()
+	defer l.muNotify.Unlock()
+	for _, n := range l.closeChannelNotifies {
+		n.notify(channel)
+	}
+}
+
+// closeNotify closes the listeners once the connection and all of its
+// channels are closed, as there will be no further notifications.
+func (l *channelListeners) closeNotify() {
+	l.muNotify.Lock()
+	defer l.muNotify.Unlock()
+
+	if l.notifyClosed {
+		return
+	}
+	l.notifyClosed = true
+
+	for _, n := range l.createChannelNotifies {
+		n.close()
+	}
+	for _, n := range l.closeChannelNotifies {
+		n.close()
+	}
+	l.createChannelNotifies = nil
+	l.closeChannelNotifies = nil
+}
+
 type amqpConnection struct {
 	listener ConnectionListener
 	conn     *amqp.Connection
 
-	muNotify         sync.Mutex
-	createChannelChs []chan<- Channel
-	closeChannelChs  []chan<- Channel
+	mu       sync.RWMutex
+	closed   bool
+	channels int
+
+	channelListeners
 }
 
 func (c *amqpConnection) CreateChannel() (Channel, error) {
@@ -226,6 +431,11 @@ func (c *amqpConnection) CreateChannel() (Channel, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	c.mu.Lock()
+	c.channels++
+	c.mu.Unlock()
+
 	wrappedCh := newAMQPChannel(ch, c)
 
 	c.OnCreate(wrappedCh)
@@ -234,56 +444,57 @@ func (c *amqpConnection) CreateChannel() (Channel, error) {
 }
 
 func (c *amqpConnection) Close() error {
-	if err := c.conn.Close(); err != nil {
-		return err
-	}
-
-	if c.listener != nil {
-		c.listener.OnClose(c)
-	}
-
-	return nil
+	return c.conn.Close()
 }
 
 func (c *amqpConnection) IsOpen() bool {
-	return c.conn != nil
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !c.closed
 }
 
-func (c *amqpConnection) NotifyCreateChannel(ch chan Channel) chan Channel {
-	c.muNotify.Lock()
-	defer c.muNotify.Unlock()
-	c.createChannelChs = append(c.createChannelChs, ch)
-	return ch
-}
+// watch reports the connection as closed to the listener, whether it was
+// closed by Close or lost.
+func (c *amqpConnection) watch() {
+	<-c.conn.NotifyClose(make(chan *amqp.Error, 1))
 
-func (c *amqpConnection) NotifyCloseChannel(ch chan Channel) chan Channel {
-	c.muNotify.Lock()
-	defer c.muNotify.Unlock()
-	c.closeChannelChs = append(c.closeChannelChs, ch)
-	return ch
+	c.mu.Lock()
+	c.closed = true
+	drained := c.channels == 0
+	c.mu.Unlock()
+
+	if c.listener != nil {
+		c.listener.OnClose(c)
+	}
+	if drained {
+		c.closeNotify()
+	}
 }
 
 func (c *amqpConnection) OnCreate(channel Channel) {
-	c.muNotify.Lock()
-	defer c.muNotify.Unlock()
-	for _, ch := range c.createChannelChs {
-		ch <- channel
-	}
+	c.notifyCreateChannel(channel)
 }
 
 func (c *amqpConnection) OnClose(channel Channel) {
-	c.muNotify.Lock()
-	defer c.muNotify.Unlock()
-	for _, ch := range c.closeChannelChs {
-		ch <- channel
+	c.notifyCloseChannel(channel)
+
+	c.mu.Lock()
+	c.channels--
+	drained := c.closed && c.channels == 0
+	c.mu.Unlock()
+
+	if drained {
+		c.closeNotify()
 	}
 }
 
 func newAMQPConnection(conn *amqp.Connection, listener ConnectionListener) Connection {
-	return &amqpConnection{
+	c := &amqpConnection{
 		conn:     conn,
 		listener: listener,
 	}
+	go c.watch()
+	return c
 }
 
 var _ Connection = (*amqpConnection)(nil)
@@ -292,30 +503,86 @@ var _ ChannelListener = (*amqpConnection)(nil)
 // Channel
 
 type amqpChannel struct {
+	*amqp.Channel
 	listener ChannelListener
-	ch       *amqp.Channel
+}
+
+// watch reports the channel as closed to the listener, whether it was
+// closed by Close or by the broker.
+func (c *amqpChannel) watch() {
+	<-c.Channel.NotifyClose(make(chan *amqp.Error, 1))
+
+	if c.listener != nil {
+		c.listener.OnClose(c)
+	}
 }
 
 func newAMQPChannel(ch *amqp.Channel, listener ChannelListener) Channel {
-	return &amqpChannel{
-		ch:       ch,
+	c := &amqpChannel{
+		Channel:  ch,
 		listener: listener,
 	}
+	go c.watch()
+	return c
 }
 
 var _ Channel = (*amqpChannel)(nil)
 
 // Connection factory
 
+// factoryListeners implements the Notify methods of ConnectionFactory.
+// Notifications are queued, they never block on a listener.
+type factoryListeners struct {
+	muNotify       sync.Mutex
+	createNotifies []*notifier
+	closeNotifies  []*notifier
+}
+
+func newConnectionNotifier(ch chan Connection) *notifier {
+	return newNotifier(
+		func(v interface{}) { ch <- v.(Connection) },
+		func() { close(ch) },
+	)
+}
+
+func (l *factoryListeners) NotifyCreate(ch chan Connection) chan Connection {
+	l.muNotify.Lock()
+	defer l.muNotify.Unlock()
+	l.createNotifies = append(l.createNotifies, newConnectionNotifier(ch))
+	return ch
+}
+
+func (l *factoryListeners) NotifyClose(ch chan Connection) chan Connection {
+	l.muNotify.Lock()
+	defer l.muNotify.Unlock()
+	l.closeNotifies = append(l.closeNotifies, newConnectionNotifier(ch))
+	return ch
+}
+
+func (l *factoryListeners) notifyCreate(conn Connection) {
+	l.muNotify.Lock()
+	defer l.muNotify.Unlock()
+	for _, n := range l.createNotifies {
+		n.notify(conn)
+	}
+}
+
+func (l *factoryListeners) notifyClose(conn Connection) {
+	l.muNotify.Lock()
+	defer l.muNotify.Unlock()
+	for _, n := range l.closeNotifies {
+		n.notify(conn)
+	}
+}
+
 type singleAMQPConnectionFactory struct {
-	url string
+	url    string
+	config amqp.Config
 
 	mu   sync.Mutex
 	conn Connection
 
-	muNotify  sync.Mutex
-	createChs []chan<- Connection
-	closeChs  []chan<- Connection
+	factoryListeners
 }
 
 func (s *singleAMQPConnectionFactory) URL() string {
@@ -324,19 +591,23 @@ func (s *singleAMQPConnectionFactory) URL() string {
 
 func (s *singleAMQPConnectionFactory) Create() (Connection, error) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if s.conn == nil {
-		conn, err := amqp.Dial(s.url)
-		if err != nil {
-			return nil, err
-		}
-		s.conn = newAMQPConnection(conn, s)
+	if s.conn != nil {
+		conn := s.conn
+		s.mu.Unlock()
+		return conn, nil
+	}
 
-		s.OnCreate(s.conn)
+	conn, err := amqp.DialConfig(s.url, s.config)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
 	}
+	s.conn = newAMQPConnection(conn, s)
+	created := s.conn
+	s.mu.Unlock()
 
-	return s.conn, nil
+	s.OnCreate(created)
+	return created, nil
 }
 
 func (s *singleAMQPConnectionFactory) Close() error {
@@ -344,49 +615,83 @@ func (s *singleAMQPConnectionFactory) Close() error {
 	defer s.mu.Unlock()
 
 	if s.conn != nil {
-		if err := s.conn.Close(); err != nil {
+		conn := s.conn
+		s.conn = nil
+		if err := conn.Close(); err != nil {
 			return err
 		}
-		s.conn = nil
 	}
 
 	return nil
 }
 
-func (s *singleAMQPConnectionFactory) NotifyCreate(ch chan Connection) chan Connection {
-	s.muNotify.Lock()
-	defer s.muNotify.Unlock()
-	s.createChs = append(s.createChs, ch)
-	return ch
-}
-
-func (s *singleAMQPConnectionFactory) NotifyClose(ch chan Connection) chan Connection {
-	s.muNotify.Lock()
-	defer s.muNotify.Unlock()
-	s.closeChs = append(s.closeChs, ch)
-	return ch
-}
-
 func (s *singleAMQPConnectionFactory) OnCreate(conn Connection) {
-	s.muNotify.Lock()
-	defer s.muNotify.Unlock()
-	for _, ch := range s.createChs {
-		ch <- s.conn
-	}
+	s.notifyCreate(conn)
 }
+
 func (s *singleAMQPConnectionFactory) OnClose(conn Connection) {
-	s.muNotify.Lock()
-	defer s.muNotify.Unlock()
-	for _, ch := range s.closeChs {
-		ch <- s.conn
+	// Dial again on the next Create
+	s.mu.Lock()
+	if s.conn == conn {
+		s.conn = nil
 	}
+	s.mu.Unlock()
+
+	s.notifyClose(conn)
 }
 
+// NewSingleAMQPConnectionFactory returns a factory that holds a single
+// connection to url.
 func NewSingleAMQPConnectionFactory(url string) (ConnectionFactory, error) {
+	return NewSingleAMQPConnectionFactoryWithConfig(url, nil)
+}
+
+// NewSingleAMQPConnectionFactoryWithConfig returns a factory that holds a
+// single connection to url, made with config. A nil config connects like
+// amqp.Dial.
+func NewSingleAMQPConnectionFactoryWithConfig(url string, config *Config) (ConnectionFactory, error) {
+	if err := validateURL(url); err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = &Config{}
+	}
+	amqpConfig, err := config.AMQPConfig()
+	if err != nil {
+		return nil, err
+	}
 	return &singleAMQPConnectionFactory{
-		url: url,
+		url:    url,
+		config: amqpConfig,
 	}, nil
 }
 
+// validateURL checks that rawurl is an AMQP URL. The error doesn't contain
+// the password, as it ends up in logs.
+func validateURL(rawurl string) error {
+	if _, err := amqp.ParseURI(rawurl); err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			// It quotes the URL as is
+			err = urlErr.Err
+		}
+		return fmt.Errorf("amqp: Invalid URL %q: %s", RedactURL(rawurl), err)
+	}
+	return nil
+}
+
+// RedactURL hides the password of a broker URL, so that it can be logged.
+func RedactURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "(unparsable URL)"
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		}
+	}
+	return u.String()
+}
+
 var _ ConnectionFactory = (*singleAMQPConnectionFactory)(nil)
 var _ ConnectionListener = (*singleAMQPConnectionFactory)(nil)
@@ -30,3 +30,26 @@ func TestToAMQPTable(t *testing.T) {
 	}
 	require.Equal(t, output, toAMQPTable(input))
 }
+
+func TestFromTable(t *testing.T) {
+	input := amqp.Table{
+		"x-death": []interface{}{
+			amqp.Table{
+				"queue":  "celery",
+				"reason": "rejected",
+				"count":  int64(1),
+			},
+		},
+	}
+	output := map[string]interface{}{
+		"x-death": []interface{}{
+			map[string]interface{}{
+				"queue":  "celery",
+				"reason": "rejected",
+				"count":  int64(1),
+			},
+		},
+	}
+	require.Equal(t, output, FromTable(input))
+	require.Equal(t, input, ToTable(output))
+}
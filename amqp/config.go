@@ -0,0 +1,131 @@
+package amqp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Config tells how to connect to the broker, beyond what the URL does. The
+// zero value connects like amqp.Dial.
+type Config struct {
+	// TLS settings of amqps connections. CAFile holds the PEM certificates
+	// of the authorities to trust instead of the system ones, CertFile and
+	// KeyFile the client certificate to present. TLS, if set, is used as a
+	// base.
+	TLS        *tls.Config
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string // sent with SNI, defaults to the host of the URL
+
+	// SASLExternal authenticates with the client certificate instead of
+	// the credentials of the URL.
+	SASLExternal bool
+
+	Vhost      string        // defaults to the path of the URL
+	Heartbeat  time.Duration // defaults to 10s
+	FrameSize  int           // defaults to the server's
+	ChannelMax int           // defaults to the server's
+	Locale     string        // defaults to en_US
+
+	// ConnectionName is shown by the broker, e.g. in the management UI.
+	// Properties are sent along with it.
+	ConnectionName string
+	Properties     map[string]interface{}
+}
+
+// TLSConfig returns the TLS configuration, with the files it refers to
+// loaded.
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	if c.TLS == nil && c.CAFile == "" && c.CertFile == "" && c.ServerName == "" {
+		return nil, nil
+	}
+
+	config := new(tls.Config)
+	if c.TLS != nil {
+		config = c.TLS.Clone()
+	}
+	if c.ServerName != "" {
+		config.ServerName = c.ServerName
+	}
+
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("amqp: No certificate found in %s", c.CAFile)
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+
+	return config, nil
+}
+
+// AMQPConfig returns the configuration to dial with.
+func (c *Config) AMQPConfig() (amqp.Config, error) {
+	tlsConfig, err := c.TLSConfig()
+	if err != nil {
+		return amqp.Config{}, err
+	}
+
+	config := amqp.Config{
+		Vhost:           c.Vhost,
+		ChannelMax:      c.ChannelMax,
+		FrameSize:       c.FrameSize,
+		Heartbeat:       c.Heartbeat,
+		TLSClientConfig: tlsConfig,
+		Locale:          c.Locale,
+	}
+	if config.Heartbeat == 0 {
+		config.Heartbeat = 10 * time.Second
+	}
+	if config.Locale == "" {
+		config.Locale = "en_US"
+	}
+
+	if c.SASLExternal {
+		if tlsConfig == nil || len(tlsConfig.Certificates) == 0 {
+			return amqp.Config{}, errors.New("amqp: SASL EXTERNAL requires a client certificate")
+		}
+		config.SASL = []amqp.Authentication{&externalAuth{}}
+	}
+
+	if c.ConnectionName != "" || len(c.Properties) > 0 {
+		// The library only sends its own properties if there are none
+		config.Properties = amqp.Table{
+			"product": "nori",
+		}
+		for k, v := range ToTable(c.Properties) {
+			config.Properties[k] = v
+		}
+		if c.ConnectionName != "" {
+			config.Properties["connection_name"] = c.ConnectionName
+		}
+	}
+
+	return config, nil
+}
+
+// externalAuth is the SASL EXTERNAL mechanism, with which the broker
+// authenticates the client by its TLS certificate.
+type externalAuth struct{}
+
+func (*externalAuth) Mechanism() string { return "EXTERNAL" }
+
+func (*externalAuth) Response() string { return "" }
@@ -0,0 +1,37 @@
+package amqp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigAMQPConfig(t *testing.T) {
+	config, err := (&Config{}).AMQPConfig()
+	require.NoError(t, err)
+	require.Equal(t, 10*time.Second, config.Heartbeat)
+	require.Equal(t, "en_US", config.Locale)
+	require.Nil(t, config.TLSClientConfig)
+	require.Nil(t, config.SASL)
+	require.Nil(t, config.Properties)
+
+	config, err = (&Config{
+		ServerName:     "broker.internal",
+		Vhost:          "/tasks",
+		ConnectionName: "worker-1",
+		Properties:     map[string]interface{}{"region": "eu"},
+	}).AMQPConfig()
+	require.NoError(t, err)
+	require.Equal(t, "broker.internal", config.TLSClientConfig.ServerName)
+	require.Equal(t, "/tasks", config.Vhost)
+	require.Equal(t, amqp.Table{
+		"product":         "nori",
+		"region":          "eu",
+		"connection_name": "worker-1",
+	}, config.Properties)
+
+	_, err = (&Config{SASLExternal: true}).AMQPConfig()
+	require.EqualError(t, err, "amqp: SASL EXTERNAL requires a client certificate")
+}
@@ -0,0 +1,118 @@
+package amqp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	ErrPublishNacked  = errors.New("amqp: Message was nacked by the broker")
+	ErrConfirmTimeout = errors.New("amqp: Timed out waiting for publish confirmation")
+	ErrChannelClosed  = errors.New("amqp: Channel closed while waiting for publish confirmation")
+)
+
+// ReturnError is returned when the broker sends back a mandatory message it
+// could not route, e.g. because its reply queue is gone.
+type ReturnError struct {
+	Return amqp.Return
+}
+
+func (e *ReturnError) Error() string {
+	return fmt.Sprintf("amqp: Message returned by the broker: %d %s (exchange %q, key %q)",
+		e.Return.ReplyCode, e.Return.ReplyText, e.Return.Exchange, e.Return.RoutingKey)
+}
+
+// ConfirmedChannel is a channel in confirm mode. Its Publish waits for the
+// broker to confirm the message, and fails if the message is nacked or
+// returned.
+type ConfirmedChannel struct {
+	Channel
+	Timeout time.Duration
+
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+
+	published uint64 // delivery tag of the last published message
+	confirmed uint64 // delivery tag of the last confirmation received
+	failure   error  // first failure of the pending batch
+}
+
+func NewConfirmedChannel(ch Channel, timeout time.Duration) (*ConfirmedChannel, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, err
+	}
+
+	// Buffered so that the channel never blocks on us between publishes
+	return &ConfirmedChannel{
+		Channel:  ch,
+		Timeout:  timeout,
+		confirms: ch.NotifyPublish(make(chan amqp.Confirmation, 64)),
+		returns:  ch.NotifyReturn(make(chan amqp.Return, 64)),
+	}, nil
+}
+
+// Publish sends a message and waits for its confirmation.
+func (c *ConfirmedChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := c.PublishNoWait(exchange, key, mandatory, immediate, msg); err != nil {
+		return err
+	}
+	return c.WaitConfirms()
+}
+
+// PublishNoWait sends a message without waiting for its confirmation, so
+// that a batch of messages can be confirmed at once with WaitConfirms.
+func (c *ConfirmedChannel) PublishNoWait(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := c.Channel.Publish(exchange, key, mandatory, immediate, msg); err != nil {
+		return err
+	}
+	c.published++
+	return nil
+}
+
+// WaitConfirms waits until every message published so far is confirmed, and
+// returns the first failure among them.
+func (c *ConfirmedChannel) WaitConfirms() error {
+	var timeout <-chan time.Time
+	if c.Timeout > 0 {
+		timeout = time.After(c.Timeout)
+	}
+
+	for c.confirmed < c.published {
+		select {
+		case confirm, ok := <-c.confirms:
+			if !ok {
+				return ErrChannelClosed
+			}
+			c.confirmed = confirm.DeliveryTag
+			if !confirm.Ack && c.failure == nil {
+				c.failure = ErrPublishNacked
+			}
+
+		case <-timeout:
+			return ErrConfirmTimeout
+		}
+	}
+
+	// The broker sends basic.return before the confirmation of the same
+	// message, so all returns of the batch have been received by now.
+drain:
+	for {
+		select {
+		case ret := <-c.returns:
+			if c.failure == nil {
+				c.failure = &ReturnError{Return: ret}
+			}
+		default:
+			break drain
+		}
+	}
+
+	err := c.failure
+	c.failure = nil
+	return err
+}
+
+var _ Channel = (*ConfirmedChannel)(nil)
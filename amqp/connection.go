@@ -1,5 +1,7 @@
 package amqp
 
+import "github.com/streadway/amqp"
+
 type ConnectionFactory interface {
 	URL() string
 	Create() (Connection, error)
@@ -19,11 +21,45 @@ type Connection interface {
 	Close() error
 	IsOpen() bool
 
+	// Channel listeners are closed once the connection and all of its
+	// channels are closed.
 	NotifyCreateChannel(chan Channel) chan Channel
 	NotifyCloseChannel(chan Channel) chan Channel
 }
 
+// Channel is the subset of an AMQP channel used by nori. Its methods
+// behave like their counterparts on *amqp.Channel.
 type Channel interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDelete(name string, ifUnused, noWait bool) error
+	ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error
+	ExchangeUnbind(destination, key, source string, noWait bool, args amqp.Table) error
+
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error)
+	QueuePurge(name string, noWait bool) (int, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	QueueUnbind(name, key, exchange string, args amqp.Table) error
+
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Ack(tag uint64, multiple bool) error
+	Nack(tag uint64, multiple, requeue bool) error
+	Reject(tag uint64, requeue bool) error
+
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Confirm(noWait bool) error
+	NotifyPublish(chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(chan amqp.Return) chan amqp.Return
+
+	// NotifyClose registers a listener for when the channel is closed. The
+	// listener receives the error that caused it, or is closed without a
+	// value on a graceful Close.
+	NotifyClose(chan *amqp.Error) chan *amqp.Error
+	Close() error
 }
 
 type ChannelListener interface {
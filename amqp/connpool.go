@@ -0,0 +1,367 @@
+package amqp
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+var ErrConnectionClosed = errors.New("amqp: Connection is closed")
+
+type pooledAMQPConnectionFactory struct {
+	url            string
+	maxConnections int
+	idleTimeout    time.Duration
+	dial           func(url string, listener ConnectionListener) (Connection, error)
+
+	mu   sync.Mutex
+	conn *pooledConnection
+	// creating is set while the first connection is being dialed
+	creating *pendingDial
+
+	factoryListeners
+}
+
+// pendingDial lets concurrent calls to Create wait for the same dial.
+type pendingDial struct {
+	done chan struct{}
+	err  error
+}
+
+func (f *pooledAMQPConnectionFactory) URL() string {
+	return f.url
+}
+
+// Create returns a connection that spreads its channels over a pool of
+// broker connections.
+func (f *pooledAMQPConnectionFactory) Create() (Connection, error) {
+	f.mu.Lock()
+	if f.conn != nil {
+		p := f.conn
+		f.mu.Unlock()
+		return p, nil
+	}
+	if pending := f.creating; pending != nil {
+		// Another Create is dialing, share its outcome
+		f.mu.Unlock()
+		<-pending.done
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if pending.err != nil {
+			return nil, pending.err
+		}
+		if f.conn == nil {
+			return nil, ErrConnectionClosed
+		}
+		return f.conn, nil
+	}
+	pending := &pendingDial{done: make(chan struct{})}
+	f.creating = pending
+	f.mu.Unlock()
+
+	// Dial without the lock, so that Close doesn't wait for it
+	p := &pooledConnection{factory: f}
+	conn, err := p.dial()
+
+	f.mu.Lock()
+	if f.creating != pending {
+		// Closed meanwhile, waiters were told already
+		f.mu.Unlock()
+		if err == nil {
+			conn.Close()
+		}
+		return nil, ErrConnectionClosed
+	}
+	f.creating = nil
+	pending.err = err
+	close(pending.done)
+	if err != nil {
+		f.mu.Unlock()
+		return nil, err
+	}
+	p.mu.Lock()
+	p.add(conn)
+	p.mu.Unlock()
+	f.conn = p
+	f.mu.Unlock()
+
+	p.OnCreate(conn)
+	return p, nil
+}
+
+func (f *pooledAMQPConnectionFactory) Close() error {
+	f.mu.Lock()
+	p := f.conn
+	f.conn = nil
+	if f.creating != nil {
+		f.creating.err = ErrConnectionClosed
+		close(f.creating.done)
+		f.creating = nil
+	}
+	f.mu.Unlock()
+
+	if p != nil {
+		return p.Close()
+	}
+	return nil
+}
+
+// pooledConnection is the Connection returned by the pooled factory. Every
+// channel is created on the least busy of its connections, a new one is
+// dialed while all of them are in use and there are less than the maximum.
+// Connections without channels are closed once idle for the idle timeout,
+// but the last one.
+type pooledConnection struct {
+	factory *pooledAMQPConnectionFactory
+
+	mu         sync.Mutex
+	conns      []*pooledEntry
+	closed     bool
+	forwarders sync.WaitGroup
+
+	channelListeners
+}
+
+type pooledEntry struct {
+	conn     Connection
+	channels int
+	idle     *time.Timer
+}
+
+func (p *pooledConnection) CreateChannel() (Channel, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrConnectionClosed
+	}
+	e := p.pick()
+	var added, discarded Connection
+	if e == nil {
+		// Dial without the lock, channels keep being created on the other
+		// connections meanwhile
+		p.mu.Unlock()
+		conn, err := p.dial()
+		if err != nil {
+			return nil, err
+		}
+
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			conn.Close()
+			return nil, ErrConnectionClosed
+		}
+		// Another channel may have grown the pool in the meantime
+		if e = p.pick(); e != nil {
+			discarded = conn
+		} else {
+			e = p.add(conn)
+			added = conn
+		}
+	}
+	e.channels++
+	if e.idle != nil {
+		e.idle.Stop()
+		e.idle = nil
+	}
+	p.mu.Unlock()
+
+	if discarded != nil {
+		discarded.Close()
+	}
+	if added != nil {
+		p.OnCreate(added)
+	}
+
+	ch, err := e.conn.CreateChannel()
+	if err != nil {
+		p.release(e)
+		return nil, err
+	}
+	p.notifyCreateChannel(ch)
+	return ch, nil
+}
+
+// pick returns the least busy connection, or nil if another one should be
+// dialed.
+func (p *pooledConnection) pick() *pooledEntry {
+	var least *pooledEntry
+	for _, e := range p.conns {
+		if least == nil || e.channels < least.channels {
+			least = e
+		}
+	}
+	if least == nil || least.channels > 0 && len(p.conns) < p.factory.maxConnections {
+		return nil
+	}
+	return least
+}
+
+// dial connects another connection for the pool, without adding it.
+func (p *pooledConnection) dial() (Connection, error) {
+	return p.factory.dial(p.factory.url, p)
+}
+
+// add puts a dialed connection in the pool. It must be called with the lock
+// held.
+func (p *pooledConnection) add(conn Connection) *pooledEntry {
+	e := &pooledEntry{conn: conn}
+	p.conns = append(p.conns, e)
+
+	// Registered before any channel is created on the connection
+	closeChan := conn.NotifyCloseChannel(make(chan Channel, 1))
+	p.forwarders.Add(1)
+	go func() {
+		defer p.forwarders.Done()
+		for ch := range closeChan {
+			p.notifyCloseChannel(ch)
+			p.release(e)
+		}
+	}()
+	return e
+}
+
+// release accounts for a channel of the connection being closed.
+func (p *pooledConnection) release(e *pooledEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e.channels--
+	if e.channels == 0 && p.factory.idleTimeout > 0 && !p.closed {
+		e.idle = time.AfterFunc(p.factory.idleTimeout, func() { p.evict(e) })
+	}
+}
+
+// evict closes a connection that stayed idle, unless it is the last one.
+func (p *pooledConnection) evict(e *pooledEntry) {
+	p.mu.Lock()
+	if e.channels > 0 || len(p.conns) <= 1 || !p.remove(e.conn) {
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+
+	e.conn.Close()
+}
+
+// remove drops a connection from the pool, and reports whether it was in
+// it. It must be called with the lock held.
+func (p *pooledConnection) remove(conn Connection) bool {
+	for i, e := range p.conns {
+		if e.conn == conn {
+			if e.idle != nil {
+				e.idle.Stop()
+			}
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of connections in the pool.
+func (p *pooledConnection) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+// IsOpen reports whether any connection of the pool is open.
+func (p *pooledConnection) IsOpen() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return false
+	}
+	for _, e := range p.conns {
+		if e.conn.IsOpen() {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *pooledConnection) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	conns := p.conns
+	p.conns = nil
+	for _, e := range conns {
+		if e.idle != nil {
+			e.idle.Stop()
+		}
+	}
+	p.mu.Unlock()
+
+	var firstErr error
+	for _, e := range conns {
+		if err := e.conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	go func() {
+		p.forwarders.Wait()
+		p.closeNotify()
+	}()
+	return firstErr
+}
+
+func (p *pooledConnection) OnCreate(conn Connection) {
+	p.factory.notifyCreate(conn)
+}
+
+// OnClose drops a lost connection from the pool, channels are created on
+// the others from then on.
+func (p *pooledConnection) OnClose(conn Connection) {
+	p.mu.Lock()
+	p.remove(conn)
+	p.mu.Unlock()
+
+	p.factory.notifyClose(conn)
+}
+
+// NewPooledAMQPConnectionFactory returns a factory whose connection spreads
+// channels over up to maxConnections connections to url, made with config.
+// Connections left without channels for idleTimeout are closed, zero keeps
+// them open.
+func NewPooledAMQPConnectionFactory(url string, maxConnections int, idleTimeout time.Duration, config *Config) (ConnectionFactory, error) {
+	if err := validateURL(url); err != nil {
+		return nil, err
+	}
+	if maxConnections <= 0 {
+		return nil, errors.New("amqp: Connection pool size must be positive")
+	}
+	if config == nil {
+		config = &Config{}
+	}
+	amqpConfig, err := config.AMQPConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return &pooledAMQPConnectionFactory{
+		url:            url,
+		maxConnections: maxConnections,
+		idleTimeout:    idleTimeout,
+		dial: func(url string, listener ConnectionListener) (Connection, error) {
+			conn, err := amqp.DialConfig(url, amqpConfig)
+			if err != nil {
+				return nil, err
+			}
+			return newAMQPConnection(conn, listener), nil
+		},
+	}, nil
+}
+
+var _ ConnectionFactory = (*pooledAMQPConnectionFactory)(nil)
+var _ Connection = (*pooledConnection)(nil)
+var _ ConnectionListener = (*pooledConnection)(nil)
@@ -0,0 +1,54 @@
+package amqp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// maxDelayLevel bounds delays to 2^27 seconds, a little over 4 years.
+const maxDelayLevel = 27
+
+// DelayBucket returns the delay a message should be held for on the broker:
+// the longest power of two seconds that isn't longer than delay, or 0 if
+// delay is under a second. Limiting delays to a few buckets limits the
+// number of delay queues; what remains of the delay is left to the
+// consumer.
+func DelayBucket(delay time.Duration) time.Duration {
+	if delay < time.Second {
+		return 0
+	}
+	level := uint(0)
+	for level < maxDelayLevel && time.Duration(1)<<(level+1)*time.Second <= delay {
+		level++
+	}
+	return time.Duration(1) << level * time.Second
+}
+
+// NewDelayQueue returns a durable queue that holds messages for delay, then
+// dead-letters them to exchange with routingKey. Messages are published to
+// it through the default exchange, with its name as the routing key.
+func NewDelayQueue(delay time.Duration, exchange, routingKey string) (*Queue, error) {
+	if delay <= 0 {
+		return nil, errors.New("amqp: Delay must be positive")
+	}
+	if routingKey == "" {
+		// The message would be dead-lettered back to the delay queue
+		return nil, errors.New("amqp: Delay queue needs a routing key")
+	}
+
+	ms := int64(delay / time.Millisecond)
+	q, err := NewQueue(
+		fmt.Sprintf("nori.delay.%d.%s.%s", ms, exchange, routingKey), // name string
+		true,  // durable bool
+		false, // exclusive bool
+		false, // autoDelete bool
+		nil,   // args map[string]interface{}
+	)
+	if err != nil {
+		return nil, err
+	}
+	q.SetArg("x-message-ttl", ms)
+	q.SetDeadLetter(exchange, routingKey)
+	return q, nil
+}
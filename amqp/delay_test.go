@@ -0,0 +1,39 @@
+package amqp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelayBucket(t *testing.T) {
+	cases := map[time.Duration]time.Duration{
+		0:                       0,
+		999 * time.Millisecond:  0,
+		time.Second:             time.Second,
+		1500 * time.Millisecond: time.Second,
+		2 * time.Second:         2 * time.Second,
+		time.Minute:             32 * time.Second,
+		time.Hour:               2048 * time.Second,
+		100000 * time.Hour:      (1 << maxDelayLevel) * time.Second,
+	}
+	for delay, expected := range cases {
+		require.Equal(t, expected, DelayBucket(delay), "delay %s", delay)
+	}
+}
+
+func TestNewDelayQueue(t *testing.T) {
+	q, err := NewDelayQueue(4*time.Second, "celery", "tasks")
+	require.NoError(t, err)
+	require.Equal(t, "nori.delay.4000.celery.tasks", q.Name)
+	require.True(t, q.Durable)
+	require.Equal(t, map[string]interface{}{
+		"x-message-ttl":             int64(4000),
+		"x-dead-letter-exchange":    "celery",
+		"x-dead-letter-routing-key": "tasks",
+	}, q.Args)
+
+	_, err = NewDelayQueue(time.Second, "celery", "")
+	require.Error(t, err)
+}
@@ -0,0 +1,194 @@
+package amqp
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/jianyuan/nori/backoff"
+	"github.com/streadway/amqp"
+)
+
+// Failover strategies, telling in which order brokers are tried
+const (
+	FailoverRoundRobin = "round-robin"
+	FailoverShuffle    = "shuffle"
+)
+
+// Bounds of the backoff before a broker that failed is tried again
+const (
+	failoverMinDelay = time.Second
+	failoverMaxDelay = time.Minute
+)
+
+type failoverAMQPConnectionFactory struct {
+	urls     []string
+	strategy string
+	dial     func(url string) (*amqp.Connection, error)
+
+	mu       sync.Mutex
+	conn     Connection
+	current  int
+	next     int
+	backoffs []*backoff.Backoff
+	retryAt  []time.Time
+
+	factoryListeners
+}
+
+// URL returns the URL of the broker connected to, or that will be tried
+// first.
+func (f *failoverAMQPConnectionFactory) URL() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.conn != nil {
+		return f.urls[f.current]
+	}
+	return f.urls[f.next]
+}
+
+// Create returns the current connection, or connects to the first broker
+// that accepts it. Brokers that failed are skipped until their backoff
+// delay is over. Brokers are dialed without holding the lock, so that URL,
+// Close and OnClose don't wait on a slow broker.
+func (f *failoverAMQPConnectionFactory) Create() (Connection, error) {
+	f.mu.Lock()
+	if f.conn != nil {
+		conn := f.conn
+		f.mu.Unlock()
+		return conn, nil
+	}
+	var candidates []int
+	now := time.Now()
+	for _, i := range f.order() {
+		if !now.Before(f.retryAt[i]) {
+			candidates = append(candidates, i)
+		}
+	}
+	f.mu.Unlock()
+
+	var lastErr error
+	for _, i := range candidates {
+		conn, err := f.dial(f.urls[i])
+		if err != nil {
+			lastErr = err
+			f.mu.Lock()
+			f.retryAt[i] = time.Now().Add(f.backoffs[i].Duration())
+			f.mu.Unlock()
+			continue
+		}
+
+		f.mu.Lock()
+		f.backoffs[i].Reset()
+		if f.conn != nil {
+			// Another Create connected in the meantime
+			existing := f.conn
+			f.mu.Unlock()
+			conn.Close()
+			return existing, nil
+		}
+		f.current = i
+		f.next = (i + 1) % len(f.urls)
+		f.conn = newAMQPConnection(conn, f)
+		created := f.conn
+		f.mu.Unlock()
+
+		f.notifyCreate(created)
+		return created, nil
+	}
+
+	if lastErr == nil {
+		return nil, errors.New("amqp: All brokers are backing off")
+	}
+	return nil, fmt.Errorf("amqp: No broker available, last error: %s", lastErr)
+}
+
+// order returns the indexes of the URLs in the order to try them.
+func (f *failoverAMQPConnectionFactory) order() []int {
+	if f.strategy == FailoverShuffle {
+		return rand.Perm(len(f.urls))
+	}
+
+	order := make([]int, len(f.urls))
+	for i := range order {
+		order[i] = (f.next + i) % len(f.urls)
+	}
+	return order
+}
+
+func (f *failoverAMQPConnectionFactory) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.conn != nil {
+		conn := f.conn
+		f.conn = nil
+		return conn.Close()
+	}
+	return nil
+}
+
+func (f *failoverAMQPConnectionFactory) OnCreate(conn Connection) {}
+
+// OnClose forgets a lost connection, so that the next Create fails over to
+// the next broker.
+func (f *failoverAMQPConnectionFactory) OnClose(conn Connection) {
+	f.mu.Lock()
+	if f.conn == conn {
+		f.conn = nil
+	}
+	f.mu.Unlock()
+
+	f.notifyClose(conn)
+}
+
+// NewFailoverAMQPConnectionFactory returns a factory that holds a single
+// connection to one of several brokers, made with config. On dial failure
+// or connection loss it moves on to the next broker, in the order given by
+// strategy.
+func NewFailoverAMQPConnectionFactory(urls []string, strategy string, config *Config) (ConnectionFactory, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("amqp: No broker URL specified")
+	}
+	switch strategy {
+	case "":
+		strategy = FailoverRoundRobin
+	case FailoverRoundRobin, FailoverShuffle:
+	default:
+		return nil, fmt.Errorf("amqp: Unknown failover strategy %q", strategy)
+	}
+
+	if config == nil {
+		config = &Config{}
+	}
+	amqpConfig, err := config.AMQPConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	f := &failoverAMQPConnectionFactory{
+		urls:     urls,
+		strategy: strategy,
+		dial: func(url string) (*amqp.Connection, error) {
+			// Dialing sets the server name of the TLS config to the host
+			// of the URL, don't let it carry over to other brokers
+			config := amqpConfig
+			if config.TLSClientConfig != nil {
+				config.TLSClientConfig = config.TLSClientConfig.Clone()
+			}
+			return amqp.DialConfig(url, config)
+		},
+		backoffs: make([]*backoff.Backoff, len(urls)),
+		retryAt:  make([]time.Time, len(urls)),
+	}
+	for i := range f.backoffs {
+		f.backoffs[i] = backoff.New(failoverMinDelay, failoverMaxDelay)
+	}
+	return f, nil
+}
+
+var _ ConnectionFactory = (*failoverAMQPConnectionFactory)(nil)
+var _ ConnectionListener = (*failoverAMQPConnectionFactory)(nil)
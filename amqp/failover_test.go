@@ -0,0 +1,72 @@
+package amqp
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailoverAMQPConnectionFactory(t *testing.T) {
+	factory, err := NewFailoverAMQPConnectionFactory([]string{"amqp://a", "amqp://b", "amqp://c"}, "", nil)
+	require.NoError(t, err)
+	f := factory.(*failoverAMQPConnectionFactory)
+
+	var dialed []string
+	f.dial = func(url string) (*amqp.Connection, error) {
+		dialed = append(dialed, url)
+		return nil, errors.New("connection refused")
+	}
+
+	_, err = f.Create()
+	require.EqualError(t, err, "amqp: No broker available, last error: connection refused")
+	require.Equal(t, []string{"amqp://a", "amqp://b", "amqp://c"}, dialed)
+
+	// Every broker is backing off
+	_, err = f.Create()
+	require.EqualError(t, err, "amqp: All brokers are backing off")
+	require.Len(t, dialed, 3)
+
+	f.next = 1
+	require.Equal(t, []int{1, 2, 0}, f.order())
+	require.Equal(t, "amqp://b", f.URL())
+
+	_, err = NewFailoverAMQPConnectionFactory(nil, "", nil)
+	require.Error(t, err)
+	_, err = NewFailoverAMQPConnectionFactory([]string{"amqp://a"}, "random", nil)
+	require.Error(t, err)
+}
+
+func TestFailoverAMQPConnectionFactoryDialUnlocked(t *testing.T) {
+	factory, err := NewFailoverAMQPConnectionFactory([]string{"amqp://a", "amqp://b"}, "", nil)
+	require.NoError(t, err)
+	f := factory.(*failoverAMQPConnectionFactory)
+
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	f.dial = func(url string) (*amqp.Connection, error) {
+		if url == "amqp://a" {
+			close(dialing)
+			<-release
+		}
+		return nil, errors.New("connection refused")
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := f.Create()
+		done <- err
+	}()
+
+	// The factory stays usable while a broker is being dialed
+	<-dialing
+	require.Equal(t, "amqp://a", f.URL())
+	require.NoError(t, f.Close())
+
+	close(release)
+	require.EqualError(t, <-done, "amqp: No broker available, last error: connection refused")
+	require.False(t, time.Now().After(f.retryAt[0]))
+	require.False(t, time.Now().After(f.retryAt[1]))
+}
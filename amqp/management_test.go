@@ -0,0 +1,71 @@
+package amqp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagementAdmin(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		if username != "admin" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.EscapedPath() {
+		case "/api/queues/%2F":
+			w.Write([]byte(`[
+				{"name": "celery", "vhost": "/", "durable": true, "messages": 12, "messages_ready": 10, "messages_unacknowledged": 2, "consumers": 3},
+				{"name": "a1b2c3", "vhost": "/", "auto_delete": true, "consumers": 0, "idle_since": "2016-01-02 15:04:05"}
+			]`))
+		case "/api/exchanges/%2F/celery":
+			w.Write([]byte(`{"name": "celery", "vhost": "/", "type": "direct", "durable": true, "auto_delete": false, "arguments": {}}`))
+		case "/api/queues/%2F/celery":
+			w.Write([]byte(`{"name": "celery", "vhost": "/", "type": "quorum", "messages": 12, "consumers": 3}`))
+		case "/api/queues/%2F/celery/bindings":
+			w.Write([]byte(`[{"source": "celery", "vhost": "/", "destination": "celery", "destination_type": "queue", "routing_key": "celery"}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	admin, err := NewManagementAdmin(&fakeAdmin{}, "http://admin:secret@"+server.Listener.Addr().String()+"/", "")
+	require.NoError(t, err)
+
+	queues, err := admin.Queues()
+	require.NoError(t, err)
+	require.Len(t, queues, 2)
+	require.Equal(t, "celery", queues[0].Name)
+	require.Equal(t, 12, queues[0].Messages)
+	require.Equal(t, 3, queues[0].Consumers)
+	require.Zero(t, queues[0].Idle())
+	require.Equal(t, 0, queues[1].Consumers)
+	require.NotZero(t, queues[1].Idle())
+
+	e, err := admin.ExchangeInfo("celery")
+	require.NoError(t, err)
+	require.Equal(t, "direct", e.Type)
+	require.True(t, e.Durable)
+
+	q, err := admin.QueueInfo("celery")
+	require.NoError(t, err)
+	require.Equal(t, QueueTypeQuorum, q.Type)
+
+	bindings, err := admin.QueueBindings("celery")
+	require.NoError(t, err)
+	require.Equal(t, []BindingInfo{{
+		Source:          "celery",
+		Vhost:           "/",
+		Destination:     "celery",
+		DestinationType: "queue",
+		RoutingKey:      "celery",
+	}}, bindings)
+
+	_, err = admin.Consumers()
+	require.EqualError(t, err, "amqp: Management API responded 404 Not Found to GET /api/consumers/%2F")
+}
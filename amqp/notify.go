@@ -0,0 +1,68 @@
+package amqp
+
+import "sync"
+
+// notifier delivers notifications to a listener channel in order. They are
+// queued, so that a listener that doesn't drain its channel never blocks the
+// connection or factory notifying it, and none is dropped.
+type notifier struct {
+	mu      sync.Mutex
+	queue   []interface{}
+	closing bool
+	wake    chan struct{}
+}
+
+// newNotifier starts delivering notifications with send, and calls
+// closeFn once closed and all of them are delivered.
+func newNotifier(send func(interface{}), closeFn func()) *notifier {
+	n := &notifier{wake: make(chan struct{}, 1)}
+	go n.run(send, closeFn)
+	return n
+}
+
+func (n *notifier) notify(v interface{}) {
+	n.mu.Lock()
+	if !n.closing {
+		n.queue = append(n.queue, v)
+	}
+	n.mu.Unlock()
+	n.signal()
+}
+
+// close closes the listener channel once the queued notifications are
+// delivered.
+func (n *notifier) close() {
+	n.mu.Lock()
+	n.closing = true
+	n.mu.Unlock()
+	n.signal()
+}
+
+func (n *notifier) signal() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (n *notifier) run(send func(interface{}), closeFn func()) {
+	for range n.wake {
+		for {
+			n.mu.Lock()
+			if len(n.queue) == 0 {
+				closing := n.closing
+				n.mu.Unlock()
+				if closing {
+					closeFn()
+					return
+				}
+				break
+			}
+			v := n.queue[0]
+			n.queue = n.queue[1:]
+			n.mu.Unlock()
+
+			send(v)
+		}
+	}
+}
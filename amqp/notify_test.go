@@ -0,0 +1,58 @@
+package amqp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFactoryListenersDontBlock(t *testing.T) {
+	var l factoryListeners
+	// Never drained until the end
+	stalled := l.NotifyCreate(make(chan Connection))
+	drained := l.NotifyCreate(make(chan Connection, 3))
+
+	conns := []Connection{&fakeConnection{}, &fakeConnection{}, &fakeConnection{}}
+	done := make(chan struct{})
+	go func() {
+		for _, conn := range conns {
+			l.notifyCreate(conn)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Notifying blocked on a listener")
+	}
+
+	// Delivered in order, none dropped
+	for _, conn := range conns {
+		require.Equal(t, conn, <-drained)
+	}
+	for _, conn := range conns {
+		require.Equal(t, conn, <-stalled)
+	}
+}
+
+func TestChannelListenersCloseAfterDelivery(t *testing.T) {
+	var l channelListeners
+	closeChan := l.NotifyCloseChannel(make(chan Channel))
+
+	channels := []Channel{&fakeChannel{}, &fakeChannel{}}
+	for _, ch := range channels {
+		l.notifyCloseChannel(ch)
+	}
+	l.closeNotify()
+
+	var received []Channel
+	for ch := range closeChan {
+		received = append(received, ch)
+	}
+	require.Equal(t, channels, received)
+
+	// Listeners registered from then on are closed straight away
+	_, ok := <-l.NotifyCreateChannel(make(chan Channel))
+	require.False(t, ok)
+}
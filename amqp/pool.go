@@ -0,0 +1,205 @@
+package amqp
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrPoolClosed  = errors.New("amqp: Channel pool is closed")
+	ErrPoolTimeout = errors.New("amqp: Timed out waiting for a channel")
+)
+
+// ChannelPool lends channels of a connection to concurrent users, so that
+// no channel is used by more than one goroutine at a time. At most
+// MaxChannels channels are open at once, Get blocks when all of them are
+// borrowed, until one is given back or the pool is closed.
+type ChannelPool struct {
+	conn        Connection
+	maxChannels int
+
+	// Wrap, if set, is applied to every channel opened by the pool, e.g. to
+	// put it in confirm mode. Get returns the wrapped channel.
+	Wrap func(Channel) (Channel, error)
+
+	// Timeout, if positive, caps how long Get waits for a channel while
+	// all of them are borrowed
+	Timeout time.Duration
+
+	// slots holds a token for every borrowed channel
+	slots chan struct{}
+	done  chan struct{}
+
+	mu     sync.Mutex
+	idle   []Channel
+	open   map[Channel]Channel // wrapped channel to the one it wraps
+	closed bool
+}
+
+func NewChannelPool(conn Connection, maxChannels int) (*ChannelPool, error) {
+	if conn == nil {
+		return nil, errors.New("amqp: Connection is nil")
+	}
+	if maxChannels <= 0 {
+		return nil, errors.New("amqp: Channel pool size must be positive")
+	}
+
+	p := &ChannelPool{
+		conn:        conn,
+		maxChannels: maxChannels,
+		slots:       make(chan struct{}, maxChannels),
+		done:        make(chan struct{}),
+		open:        make(map[Channel]Channel),
+	}
+
+	closeChan := conn.NotifyCloseChannel(make(chan Channel, maxChannels))
+	go func() {
+		for ch := range closeChan {
+			p.discard(ch)
+		}
+	}()
+
+	return p, nil
+}
+
+// Get borrows a channel from the pool, opening one if none is idle. The
+// channel must be given back with Put.
+func (p *ChannelPool) Get() (Channel, error) {
+	var timeout <-chan time.Time
+	if p.Timeout > 0 {
+		timer := time.NewTimer(p.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case p.slots <- struct{}{}:
+	case <-p.done:
+		return nil, ErrPoolClosed
+	case <-timeout:
+		return nil, ErrPoolTimeout
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.slots
+		return nil, ErrPoolClosed
+	}
+	if n := len(p.idle); n > 0 {
+		ch := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return ch, nil
+	}
+	p.mu.Unlock()
+
+	ch, err := p.create()
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (p *ChannelPool) create() (Channel, error) {
+	ch, err := p.conn.CreateChannel()
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := ch
+	if p.Wrap != nil {
+		if wrapped, err = p.Wrap(ch); err != nil {
+			ch.Close()
+			return nil, err
+		}
+	}
+
+	p.mu.Lock()
+	p.open[wrapped] = ch
+	p.mu.Unlock()
+
+	return wrapped, nil
+}
+
+// Put gives back a borrowed channel. Channels that were closed in the
+// meantime are dropped from the pool.
+func (p *ChannelPool) Put(ch Channel) {
+	defer func() { <-p.slots }()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.open[ch]; !ok {
+		return
+	}
+	if p.closed {
+		delete(p.open, ch)
+		ch.Close()
+		return
+	}
+	p.idle = append(p.idle, ch)
+}
+
+// Discard closes a borrowed channel that is no longer usable instead of
+// giving it back.
+func (p *ChannelPool) Discard(ch Channel) {
+	defer func() { <-p.slots }()
+
+	p.mu.Lock()
+	delete(p.open, ch)
+	p.mu.Unlock()
+
+	ch.Close()
+}
+
+// Len returns the number of open channels.
+func (p *ChannelPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.open)
+}
+
+// discard drops a channel that was closed from the pool.
+func (p *ChannelPool) discard(closed Channel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for wrapped, ch := range p.open {
+		if ch != closed {
+			continue
+		}
+		delete(p.open, wrapped)
+		for i, idle := range p.idle {
+			if idle == wrapped {
+				p.idle = append(p.idle[:i], p.idle[i+1:]...)
+				break
+			}
+		}
+		return
+	}
+}
+
+// Close closes the idle channels, and makes waiting Get calls return
+// ErrPoolClosed. Borrowed channels are closed as they are given back.
+func (p *ChannelPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+
+	var firstErr error
+	for _, ch := range p.idle {
+		delete(p.open, ch)
+		if err := ch.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	p.idle = nil
+	return firstErr
+}
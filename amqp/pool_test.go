@@ -0,0 +1,155 @@
+package amqp
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeChannel struct {
+	Channel
+	closed bool
+}
+
+func (c *fakeChannel) Close() error {
+	c.closed = true
+	return nil
+}
+
+type fakeConnection struct {
+	Connection
+
+	mu       sync.Mutex
+	created  int
+	closeChs []chan Channel
+}
+
+func (c *fakeConnection) CreateChannel() (Channel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.created++
+	return &fakeChannel{}, nil
+}
+
+func (c *fakeConnection) NotifyCloseChannel(ch chan Channel) chan Channel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeChs = append(c.closeChs, ch)
+	return ch
+}
+
+func (c *fakeConnection) closeChannel(ch Channel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, closeCh := range c.closeChs {
+		closeCh <- ch
+	}
+}
+
+func TestChannelPoolReuse(t *testing.T) {
+	conn := &fakeConnection{}
+	p, err := NewChannelPool(conn, 2)
+	require.NoError(t, err)
+
+	ch1, err := p.Get()
+	require.NoError(t, err)
+	p.Put(ch1)
+
+	ch2, err := p.Get()
+	require.NoError(t, err)
+	require.True(t, ch1 == ch2)
+	require.Equal(t, 1, conn.created)
+	p.Put(ch2)
+
+	require.NoError(t, p.Close())
+	require.True(t, ch1.(*fakeChannel).closed)
+
+	_, err = p.Get()
+	require.Equal(t, ErrPoolClosed, err)
+}
+
+func TestChannelPoolLimit(t *testing.T) {
+	conn := &fakeConnection{}
+	p, err := NewChannelPool(conn, 2)
+	require.NoError(t, err)
+
+	ch1, err := p.Get()
+	require.NoError(t, err)
+	_, err = p.Get()
+	require.NoError(t, err)
+
+	got := make(chan Channel)
+	go func() {
+		ch, _ := p.Get()
+		got <- ch
+	}()
+
+	select {
+	case <-got:
+		t.Fatal("borrowed more channels than the pool size")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.Put(ch1)
+	select {
+	case ch := <-got:
+		require.True(t, ch1 == ch)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for channel")
+	}
+	require.Equal(t, 2, conn.created)
+}
+
+func TestChannelPoolDiscardsClosedChannels(t *testing.T) {
+	conn := &fakeConnection{}
+	p, err := NewChannelPool(conn, 2)
+	require.NoError(t, err)
+
+	ch, err := p.Get()
+	require.NoError(t, err)
+	p.Put(ch)
+	require.Equal(t, 1, p.Len())
+
+	conn.closeChannel(ch)
+	require.Eventually(t, func() bool { return p.Len() == 0 }, time.Second, time.Millisecond)
+
+	newCh, err := p.Get()
+	require.NoError(t, err)
+	require.False(t, ch == newCh)
+}
+
+func TestChannelPoolGetUnblocks(t *testing.T) {
+	conn := &fakeConnection{}
+	p, err := NewChannelPool(conn, 1)
+	require.NoError(t, err)
+	_, err = p.Get()
+	require.NoError(t, err)
+
+	// Gives up after the timeout
+	p.Timeout = 20 * time.Millisecond
+	start := time.Now()
+	_, err = p.Get()
+	require.Equal(t, ErrPoolTimeout, err)
+	require.True(t, time.Since(start) >= 20*time.Millisecond)
+
+	// Or once closed
+	p.Timeout = 0
+	errChan := make(chan error)
+	go func() {
+		_, err := p.Get()
+		errChan <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, p.Close())
+	select {
+	case err := <-errChan:
+		require.Equal(t, ErrPoolClosed, err)
+	case <-time.After(time.Second):
+		t.Fatal("Get still blocked after Close")
+	}
+
+	_, err = p.Get()
+	require.Equal(t, ErrPoolClosed, err)
+}
@@ -1,6 +1,16 @@
 package amqp
 
-import "sync"
+import (
+	"fmt"
+	"sync"
+)
+
+// Queue types, as set by SetType
+const (
+	QueueTypeClassic = "classic"
+	QueueTypeQuorum  = "quorum"
+	QueueTypeStream  = "stream"
+)
 
 type Queue struct {
 	Name       string
@@ -28,8 +38,53 @@ func NewQueue(
 	}, nil
 }
 
+// NewQuorumQueue returns a replicated quorum queue. Quorum queues are always
+// durable, and support neither priorities nor global QoS.
+func NewQuorumQueue(name string, args map[string]interface{}) (*Queue, error) {
+	q, err := NewQueue(
+		name,  // name string
+		true,  // durable bool
+		false, // exclusive bool
+		false, // autoDelete bool
+		args,  // args map[string]interface{}
+	)
+	if err != nil {
+		return nil, err
+	}
+	q.SetType(QueueTypeQuorum)
+	return q, nil
+}
+
+// NewStreamQueue returns a stream, an append-only log that consumers read
+// from without removing messages. Consuming requires a prefetch count.
+func NewStreamQueue(name string, args map[string]interface{}) (*Queue, error) {
+	q, err := NewQueue(
+		name,  // name string
+		true,  // durable bool
+		false, // exclusive bool
+		false, // autoDelete bool
+		args,  // args map[string]interface{}
+	)
+	if err != nil {
+		return nil, err
+	}
+	q.SetType(QueueTypeStream)
+	return q, nil
+}
+
 func (*Queue) Bindable() {}
 
+// Type returns the type of the queue, classic unless set otherwise.
+func (q *Queue) Type() string {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if kind, ok := q.Args["x-queue-type"].(string); ok {
+		return kind
+	}
+	return QueueTypeClassic
+}
+
 func (q *Queue) SetArg(key string, val interface{}) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -39,3 +94,57 @@ func (q *Queue) SetArg(key string, val interface{}) {
 	}
 	q.Args[key] = val
 }
+
+// Validate checks the queue against the restrictions of its type, which the
+// broker would otherwise refuse by closing the channel.
+func (q *Queue) Validate() error {
+	kind := q.Type()
+	switch kind {
+	case QueueTypeClassic:
+		return nil
+	case QueueTypeQuorum, QueueTypeStream:
+	default:
+		return fmt.Errorf("amqp: Unknown type %q of queue %q", kind, q.Name)
+	}
+
+	if !q.Durable || q.Exclusive || q.AutoDelete {
+		return fmt.Errorf("amqp: %s queue %q must be durable, not exclusive nor auto-deleted", kind, q.Name)
+	}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if _, ok := q.Args["x-max-priority"]; ok {
+		return fmt.Errorf("amqp: %s queue %q doesn't support priorities", kind, q.Name)
+	}
+	if _, ok := q.Args["x-delivery-limit"]; ok && kind != QueueTypeQuorum {
+		return fmt.Errorf("amqp: %s queue %q doesn't support a delivery limit", kind, q.Name)
+	}
+	return nil
+}
+
+// SetType sets the type of the queue, one of the QueueType constants.
+func (q *Queue) SetType(kind string) {
+	q.SetArg("x-queue-type", kind)
+}
+
+// SetDeliveryLimit makes a quorum queue dead-letter or drop messages that
+// were delivered more than limit times.
+func (q *Queue) SetDeliveryLimit(limit int) {
+	q.SetArg("x-delivery-limit", limit)
+}
+
+// SetMaxPriority enables priorities from 0 to max on the queue, messages
+// of higher priority are delivered first. Brokers advise a max of 10 at
+// most.
+func (q *Queue) SetMaxPriority(max uint8) {
+	q.SetArg("x-max-priority", int(max))
+}
+
+// SetDeadLetter makes the broker republish messages that are rejected or
+// expire from the queue to the given exchange. An empty routing key keeps
+// the original one.
+func (q *Queue) SetDeadLetter(exchange, routingKey string) {
+	q.SetArg("x-dead-letter-exchange", exchange)
+	if routingKey != "" {
+		q.SetArg("x-dead-letter-routing-key", routingKey)
+	}
+}
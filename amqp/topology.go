@@ -0,0 +1,497 @@
+package amqp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// Topology lists the exchanges, queues and bindings an application relies
+// on, so that they can be declared whenever a connection is made.
+type Topology struct {
+	mu        sync.Mutex
+	Exchanges []*Exchange
+	Queues    []*Queue
+	Bindings  []*Binding
+}
+
+func NewTopology() *Topology {
+	return &Topology{}
+}
+
+// ConflictError is returned when an entity is declared twice with different
+// properties, which the broker would refuse.
+type ConflictError struct {
+	Kind string
+	Name string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("amqp: Conflicting declarations of %s %q", e.Kind, e.Name)
+}
+
+// AddExchange adds an exchange, unless an identical one is already listed.
+func (t *Topology) AddExchange(e *Exchange) error {
+	if e == nil {
+		return errors.New("amqp: Exchange is nil")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if existing := t.exchange(e.Name); existing != nil {
+		if !sameExchange(existing, e) {
+			return &ConflictError{Kind: "exchange", Name: e.Name}
+		}
+		return nil
+	}
+	t.Exchanges = append(t.Exchanges, e)
+	return nil
+}
+
+// AddQueue adds a queue, unless an identical one is already listed.
+func (t *Topology) AddQueue(q *Queue) error {
+	if q == nil {
+		return errors.New("amqp: Queue is nil")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if existing := t.queue(q.Name); existing != nil {
+		if !sameQueue(existing, q) {
+			return &ConflictError{Kind: "queue", Name: q.Name}
+		}
+		return nil
+	}
+	t.Queues = append(t.Queues, q)
+	return nil
+}
+
+// AddBinding adds a binding, unless an identical one is already listed.
+func (t *Topology) AddBinding(b *Binding) error {
+	if b == nil {
+		return errors.New("amqp: Binding is nil")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, existing := range t.Bindings {
+		if sameBinding(existing, b) {
+			return nil
+		}
+	}
+	t.Bindings = append(t.Bindings, b)
+	return nil
+}
+
+// Queue returns the listed queue with the given name, or nil.
+func (t *Topology) Queue(name string) *Queue {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.queue(name)
+}
+
+// Exchange returns the listed exchange with the given name, or nil.
+func (t *Topology) Exchange(name string) *Exchange {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.exchange(name)
+}
+
+func (t *Topology) queue(name string) *Queue {
+	for _, q := range t.Queues {
+		if q.Name == name {
+			return q
+		}
+	}
+	return nil
+}
+
+func (t *Topology) exchange(name string) *Exchange {
+	for _, e := range t.Exchanges {
+		if e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// Validate checks that no entity is listed twice with different
+// properties, and that bindings refer to listed entities.
+func (t *Topology) Validate() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	exchanges := make(map[string]*Exchange)
+	for _, e := range t.Exchanges {
+		if existing, ok := exchanges[e.Name]; ok && !sameExchange(existing, e) {
+			return &ConflictError{Kind: "exchange", Name: e.Name}
+		}
+		exchanges[e.Name] = e
+	}
+
+	queues := make(map[string]*Queue)
+	for _, q := range t.Queues {
+		if existing, ok := queues[q.Name]; ok && !sameQueue(existing, q) {
+			return &ConflictError{Kind: "queue", Name: q.Name}
+		}
+		if err := q.Validate(); err != nil {
+			return err
+		}
+		queues[q.Name] = q
+	}
+
+	for _, b := range t.Bindings {
+		if b.Exchange == nil {
+			return errors.New("amqp: Binding exchange is nil")
+		}
+		if _, ok := exchanges[b.Exchange.Name]; !ok {
+			return fmt.Errorf("amqp: Binding refers to unknown exchange %q", b.Exchange.Name)
+		}
+
+		switch dest := b.Destination.(type) {
+		case nil:
+			return errors.New("amqp: Binding destination is nil")
+		case *Exchange:
+			if _, ok := exchanges[dest.Name]; !ok {
+				return fmt.Errorf("amqp: Binding refers to unknown exchange %q", dest.Name)
+			}
+		case *Queue:
+			if _, ok := queues[dest.Name]; !ok {
+				return fmt.Errorf("amqp: Binding refers to unknown queue %q", dest.Name)
+			}
+		default:
+			return fmt.Errorf("amqp: Unsupported binding destination %T", dest)
+		}
+	}
+
+	return nil
+}
+
+// Declare declares every exchange, queue and binding. Declarations are
+// idempotent, so it is safe to call on every (re)connect.
+func (t *Topology) Declare(admin Admin) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, e := range t.Exchanges {
+		if err := admin.DeclareExchange(e); err != nil {
+			return fmt.Errorf("declaring exchange %q: %s", e.Name, err)
+		}
+	}
+	for _, q := range t.Queues {
+		if err := admin.DeclareQueue(q); err != nil {
+			return fmt.Errorf("declaring queue %q: %s", q.Name, err)
+		}
+	}
+	for _, b := range t.Bindings {
+		if err := admin.DeclareBinding(b); err != nil {
+			return fmt.Errorf("declaring binding of %q: %s", b.Exchange.Name, err)
+		}
+	}
+	return nil
+}
+
+// Change is a declaration that Declare would make. When Conflict is set,
+// the entity already exists with other properties and the broker would
+// refuse the declaration.
+type Change struct {
+	Kind     string // "exchange", "queue" or "binding"
+	Name     string
+	Conflict string
+}
+
+func (c Change) String() string {
+	if c.Conflict != "" {
+		return fmt.Sprintf("conflict on %s %s: %s", c.Kind, c.Name, c.Conflict)
+	}
+	return fmt.Sprintf("declare %s %s", c.Kind, c.Name)
+}
+
+// Plan reports what Declare would change on the broker, without changing
+// anything. Bindings can't be looked up over AMQP, so those of new
+// entities are reported. If admin is a ManagementAdmin, existing entities
+// are also compared to their declarations and any mismatch is reported as
+// a conflict.
+func (t *Topology) Plan(admin Admin) ([]Change, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	management, _ := admin.(ManagementAdmin)
+	var changes []Change
+	created := make(map[string]bool)
+
+	for _, e := range t.Exchanges {
+		exists, err := admin.ExchangeExists(e.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			changes = append(changes, Change{Kind: "exchange", Name: e.Name})
+			created["exchange "+e.Name] = true
+			continue
+		}
+		if management == nil {
+			continue
+		}
+		info, err := management.ExchangeInfo(e.Name)
+		if err != nil {
+			return nil, err
+		}
+		if conflict := exchangeConflict(e, info); conflict != "" {
+			changes = append(changes, Change{Kind: "exchange", Name: e.Name, Conflict: conflict})
+		}
+	}
+	for _, q := range t.Queues {
+		exists, err := admin.QueueExists(q.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			changes = append(changes, Change{Kind: "queue", Name: q.Name})
+			created["queue "+q.Name] = true
+			continue
+		}
+		if management == nil {
+			continue
+		}
+		info, err := management.QueueInfo(q.Name)
+		if err != nil {
+			return nil, err
+		}
+		if conflict := queueConflict(q, info); conflict != "" {
+			changes = append(changes, Change{Kind: "queue", Name: q.Name, Conflict: conflict})
+		}
+	}
+	for _, b := range t.Bindings {
+		if created["exchange "+b.Exchange.Name] || created[destinationName(b)] {
+			changes = append(changes, Change{Kind: "binding", Name: bindingName(b)})
+		}
+	}
+
+	return changes, nil
+}
+
+// exchangeConflict describes how e differs from the exchange on the broker,
+// or returns "" if they match.
+func exchangeConflict(e *Exchange, info *ExchangeInfo) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var diffs []string
+	if e.Kind != info.Type {
+		diffs = append(diffs, fmt.Sprintf("type %s, broker has %s", e.Kind, info.Type))
+	}
+	if e.Durable != info.Durable {
+		diffs = append(diffs, fmt.Sprintf("durable %t, broker has %t", e.Durable, info.Durable))
+	}
+	if e.AutoDelete != info.AutoDelete {
+		diffs = append(diffs, fmt.Sprintf("auto-delete %t, broker has %t", e.AutoDelete, info.AutoDelete))
+	}
+	diffs = append(diffs, argConflicts(e.Args, info.Arguments)...)
+	return strings.Join(diffs, "; ")
+}
+
+// queueConflict describes how q differs from the queue on the broker, or
+// returns "" if they match.
+func queueConflict(q *Queue, info *QueueInfo) string {
+	var diffs []string
+	// Brokers that default the queue type report it even if undeclared
+	if kind := q.Type(); info.Type != "" && kind != info.Type {
+		diffs = append(diffs, fmt.Sprintf("type %s, broker has %s", kind, info.Type))
+	}
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.Durable != info.Durable {
+		diffs = append(diffs, fmt.Sprintf("durable %t, broker has %t", q.Durable, info.Durable))
+	}
+	if q.Exclusive != info.Exclusive {
+		diffs = append(diffs, fmt.Sprintf("exclusive %t, broker has %t", q.Exclusive, info.Exclusive))
+	}
+	if q.AutoDelete != info.AutoDelete {
+		diffs = append(diffs, fmt.Sprintf("auto-delete %t, broker has %t", q.AutoDelete, info.AutoDelete))
+	}
+
+	declared := make(map[string]interface{}, len(q.Args))
+	for key, val := range q.Args {
+		declared[key] = val
+	}
+	broker := make(map[string]interface{}, len(info.Arguments))
+	for key, val := range info.Arguments {
+		broker[key] = val
+	}
+	delete(declared, "x-queue-type")
+	delete(broker, "x-queue-type")
+	diffs = append(diffs, argConflicts(declared, broker)...)
+	return strings.Join(diffs, "; ")
+}
+
+// argConflicts describes the arguments that differ between the declared
+// ones and those reported by the broker. The declared arguments go through
+// JSON first, like the broker's, so that numbers compare equal.
+func argConflicts(declared, broker map[string]interface{}) []string {
+	var decoded map[string]interface{}
+	if len(declared) > 0 {
+		encoded, err := json.Marshal(declared)
+		if err == nil {
+			err = json.Unmarshal(encoded, &decoded)
+		}
+		if err != nil {
+			return []string{fmt.Sprintf("arguments can't be compared: %s", err)}
+		}
+	}
+
+	keys := make(map[string]bool)
+	for key := range decoded {
+		keys[key] = true
+	}
+	for key := range broker {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	var diffs []string
+	for _, key := range sorted {
+		want, declaredOK := decoded[key]
+		got, brokerOK := broker[key]
+		switch {
+		case !brokerOK:
+			diffs = append(diffs, fmt.Sprintf("%s %v, broker has none", key, want))
+		case !declaredOK:
+			diffs = append(diffs, fmt.Sprintf("%s undeclared, broker has %v", key, got))
+		case !reflect.DeepEqual(want, got):
+			diffs = append(diffs, fmt.Sprintf("%s %v, broker has %v", key, want, got))
+		}
+	}
+	return diffs
+}
+
+// destinationName returns the kind and name of the binding destination.
+func destinationName(b *Binding) string {
+	switch d := b.Destination.(type) {
+	case *Exchange:
+		return "exchange " + d.Name
+	case *Queue:
+		return "queue " + d.Name
+	default:
+		return ""
+	}
+}
+
+func bindingName(b *Binding) string {
+	return fmt.Sprintf("%s -> %s (%s)", b.Exchange.Name, destinationName(b), b.RoutingKey)
+}
+
+func sameExchange(a, b *Exchange) bool {
+	if a == b {
+		return true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return a.Kind == b.Kind &&
+		a.Durable == b.Durable &&
+		a.AutoDelete == b.AutoDelete &&
+		sameArgs(a.Args, b.Args)
+}
+
+func sameQueue(a, b *Queue) bool {
+	if a == b {
+		return true
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return a.Durable == b.Durable &&
+		a.Exclusive == b.Exclusive &&
+		a.AutoDelete == b.AutoDelete &&
+		sameArgs(a.Args, b.Args)
+}
+
+func sameBinding(a, b *Binding) bool {
+	if a == b {
+		return true
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return a.Exchange != nil && b.Exchange != nil &&
+		a.Exchange.Name == b.Exchange.Name &&
+		destinationName(a) == destinationName(b) &&
+		a.RoutingKey == b.RoutingKey &&
+		sameArgs(a.Args, b.Args)
+}
+
+func sameArgs(a, b map[string]interface{}) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(normalizeArg(a), normalizeArg(b))
+}
+
+// normalizeArg converts numbers to int64 or float64, so that arguments
+// given as different Go types but encoded the same compare equal.
+func normalizeArg(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case amqp.Table:
+		return normalizeArg(map[string]interface{}(v))
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[key] = normalizeArg(val)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, val := range v {
+			s[i] = normalizeArg(val)
+		}
+		return s
+	default:
+		return v
+	}
+}
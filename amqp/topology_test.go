@@ -0,0 +1,181 @@
+package amqp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeAdmin struct {
+	Admin
+	exchanges map[string]bool
+	queues    map[string]bool
+	declared  []string
+}
+
+func (a *fakeAdmin) ExchangeExists(name string) (bool, error) { return a.exchanges[name], nil }
+
+func (a *fakeAdmin) QueueExists(name string) (bool, error) { return a.queues[name], nil }
+
+func (a *fakeAdmin) DeclareExchange(e *Exchange) error {
+	a.declared = append(a.declared, "exchange "+e.Name)
+	return nil
+}
+
+func (a *fakeAdmin) DeclareQueue(q *Queue) error {
+	a.declared = append(a.declared, "queue "+q.Name)
+	return nil
+}
+
+func (a *fakeAdmin) DeclareBinding(b *Binding) error {
+	a.declared = append(a.declared, "binding "+bindingName(b))
+	return nil
+}
+
+func newTestTopology(t *testing.T) *Topology {
+	exchange, _ := NewExchange("direct", "celery", true, false, nil)
+	celery, _ := NewQueue("celery", true, false, false, nil)
+	priority, _ := NewQueue("priority", true, false, false, map[string]interface{}{"x-max-priority": 10})
+
+	topology := NewTopology()
+	require.NoError(t, topology.AddExchange(exchange))
+	for _, q := range []*Queue{celery, priority} {
+		b, _ := NewBinding(q, exchange, q.Name, nil)
+		require.NoError(t, topology.AddQueue(q))
+		require.NoError(t, topology.AddBinding(b))
+	}
+	return topology
+}
+
+func TestTopologyConflicts(t *testing.T) {
+	topology := newTestTopology(t)
+
+	same, _ := NewQueue("priority", true, false, false, map[string]interface{}{"x-max-priority": 10})
+	require.NoError(t, topology.AddQueue(same))
+	require.Len(t, topology.Queues, 2)
+
+	// Numbers of different types are the same argument
+	sameValue, _ := NewQueue("priority", true, false, false, map[string]interface{}{"x-max-priority": int32(10)})
+	require.NoError(t, topology.AddQueue(sameValue))
+	require.Len(t, topology.Queues, 2)
+
+	conflicting, _ := NewQueue("priority", true, false, false, nil)
+	require.Equal(t, &ConflictError{Kind: "queue", Name: "priority"}, topology.AddQueue(conflicting))
+
+	exchange, _ := NewExchange("topic", "celery", true, false, nil)
+	require.Equal(t, &ConflictError{Kind: "exchange", Name: "celery"}, topology.AddExchange(exchange))
+
+	topology.Queues = append(topology.Queues, conflicting)
+	require.Equal(t, &ConflictError{Kind: "queue", Name: "priority"}, topology.Validate())
+}
+
+func TestTopologyValidateBindings(t *testing.T) {
+	topology := newTestTopology(t)
+	require.NoError(t, topology.Validate())
+
+	unknown, _ := NewQueue("unknown", true, false, false, nil)
+	b, _ := NewBinding(unknown, topology.Exchanges[0], "unknown", nil)
+	require.NoError(t, topology.AddBinding(b))
+	require.EqualError(t, topology.Validate(), `amqp: Binding refers to unknown queue "unknown"`)
+}
+
+func TestTopologyValidateQueueTypes(t *testing.T) {
+	topology := newTestTopology(t)
+
+	quorum, _ := NewQuorumQueue("quorum", nil)
+	quorum.SetDeliveryLimit(5)
+	require.NoError(t, topology.AddQueue(quorum))
+	require.NoError(t, topology.Validate())
+
+	stream, _ := NewStreamQueue("stream", nil)
+	stream.SetMaxPriority(10)
+	require.NoError(t, topology.AddQueue(stream))
+	require.EqualError(t, topology.Validate(), `amqp: stream queue "stream" doesn't support priorities`)
+}
+
+func TestTopologyDeclare(t *testing.T) {
+	admin := &fakeAdmin{}
+	require.NoError(t, newTestTopology(t).Declare(admin))
+	require.Equal(t, []string{
+		"exchange celery",
+		"queue celery",
+		"queue priority",
+		"binding celery -> queue celery (celery)",
+		"binding celery -> queue priority (priority)",
+	}, admin.declared)
+}
+
+func TestTopologyPlan(t *testing.T) {
+	admin := &fakeAdmin{
+		exchanges: map[string]bool{"celery": true},
+		queues:    map[string]bool{"celery": true},
+	}
+	changes, err := newTestTopology(t).Plan(admin)
+	require.NoError(t, err)
+	require.Equal(t, []Change{
+		{Kind: "queue", Name: "priority"},
+		{Kind: "binding", Name: "celery -> queue priority (priority)"},
+	}, changes)
+	require.Empty(t, admin.declared)
+}
+
+type fakeManagementAdmin struct {
+	ManagementAdmin
+	exchangeInfo map[string]*ExchangeInfo
+	queueInfo    map[string]*QueueInfo
+}
+
+func (a *fakeManagementAdmin) ExchangeInfo(name string) (*ExchangeInfo, error) {
+	return a.exchangeInfo[name], nil
+}
+
+func (a *fakeManagementAdmin) QueueInfo(name string) (*QueueInfo, error) {
+	return a.queueInfo[name], nil
+}
+
+func TestTopologyPlanConflicts(t *testing.T) {
+	fake := &fakeAdmin{
+		exchanges: map[string]bool{"celery": true},
+		queues:    map[string]bool{"celery": true, "priority": true},
+	}
+	management, err := NewManagementAdmin(fake, "http://localhost:15672", "")
+	require.NoError(t, err)
+	admin := &fakeManagementAdmin{
+		ManagementAdmin: management,
+		exchangeInfo: map[string]*ExchangeInfo{
+			"celery": {Name: "celery", Type: "direct", Durable: true},
+		},
+		queueInfo: map[string]*QueueInfo{
+			"celery": {Name: "celery", Type: QueueTypeClassic, Durable: false, AutoDelete: true},
+			"priority": {Name: "priority", Type: QueueTypeClassic, Durable: true, Arguments: map[string]interface{}{
+				"x-max-priority": float64(5),
+				"x-expires":      float64(60000),
+			}},
+		},
+	}
+	changes, err := newTestTopology(t).Plan(admin)
+	require.NoError(t, err)
+	require.Equal(t, []Change{
+		{Kind: "queue", Name: "celery", Conflict: "durable true, broker has false; auto-delete false, broker has true"},
+		{Kind: "queue", Name: "priority", Conflict: "x-expires undeclared, broker has 60000; x-max-priority 10, broker has 5"},
+	}, changes)
+	require.Equal(t, "conflict on queue celery: durable true, broker has false; auto-delete false, broker has true", changes[0].String())
+
+	// Matching properties, with numbers decoded from JSON, are no conflict
+	admin.queueInfo["celery"] = &QueueInfo{Name: "celery", Type: QueueTypeClassic, Durable: true}
+	admin.queueInfo["priority"].Arguments = map[string]interface{}{
+		"x-max-priority": float64(10),
+		"x-queue-type":   QueueTypeClassic,
+	}
+	changes, err = newTestTopology(t).Plan(admin)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+
+	admin.exchangeInfo["celery"].Type = "topic"
+	changes, err = newTestTopology(t).Plan(admin)
+	require.NoError(t, err)
+	require.Equal(t, []Change{
+		{Kind: "exchange", Name: "celery", Conflict: "type direct, broker has topic"},
+	}, changes)
+	require.Empty(t, fake.declared)
+}
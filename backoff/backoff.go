@@ -0,0 +1,65 @@
+package backoff
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff computes capped exponential delays between retry attempts.
+type Backoff struct {
+	Min    time.Duration
+	Max    time.Duration
+	Factor float64
+
+	// Jitter randomizes each delay between half and all of its value, so
+	// that many clients losing the same broker don't retry in lockstep.
+	Jitter bool
+
+	attempt int
+}
+
+func New(min, max time.Duration) *Backoff {
+	return &Backoff{
+		Min:    min,
+		Max:    max,
+		Factor: 2,
+		Jitter: true,
+	}
+}
+
+// Duration returns the delay before the next attempt and advances the
+// attempt counter.
+func (b *Backoff) Duration() time.Duration {
+	d := b.ForAttempt(b.attempt)
+	b.attempt++
+	return d
+}
+
+// ForAttempt returns the delay before the given (0-based) attempt.
+func (b *Backoff) ForAttempt(attempt int) time.Duration {
+	factor := b.Factor
+	if factor <= 0 {
+		factor = 2
+	}
+
+	d := float64(b.Min) * math.Pow(factor, float64(attempt))
+	if d > float64(b.Max) || math.IsInf(d, 0) || math.IsNaN(d) {
+		d = float64(b.Max)
+	}
+	if b.Jitter {
+		d = d/2 + rand.Float64()*d/2
+	}
+	if d < float64(b.Min) {
+		d = float64(b.Min)
+	}
+	return time.Duration(d)
+}
+
+func (b *Backoff) Attempt() int {
+	return b.attempt
+}
+
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,35 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoff(t *testing.T) {
+	b := New(100*time.Millisecond, time.Second)
+	b.Jitter = false
+
+	require.Equal(t, 100*time.Millisecond, b.Duration())
+	require.Equal(t, 200*time.Millisecond, b.Duration())
+	require.Equal(t, 400*time.Millisecond, b.Duration())
+	require.Equal(t, 800*time.Millisecond, b.Duration())
+	require.Equal(t, time.Second, b.Duration())
+	require.Equal(t, time.Second, b.Duration())
+	require.Equal(t, 6, b.Attempt())
+
+	b.Reset()
+	require.Equal(t, 100*time.Millisecond, b.Duration())
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := New(100*time.Millisecond, time.Second)
+
+	for attempt := 0; attempt < 100; attempt++ {
+		d := b.ForAttempt(attempt)
+		require.True(t, d >= 100*time.Millisecond, "%s below minimum", d)
+		require.True(t, d <= time.Second, "%s above maximum", d)
+	}
+	require.True(t, b.ForAttempt(1000) >= 500*time.Millisecond)
+}
@@ -0,0 +1,202 @@
+package beat
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/tomb.v2"
+
+	"github.com/jianyuan/nori/log"
+	"github.com/jianyuan/nori/message"
+)
+
+// Sender sends task requests, as nori.Client does.
+type Sender interface {
+	SendTask(name string, args []interface{}, kwargs map[string]interface{}) (*message.Request, error)
+}
+
+// Entry is a task sent on a schedule.
+type Entry struct {
+	// Name identifies the entry in the store
+	Name     string
+	Task     string
+	Args     []interface{}
+	KWArgs   map[string]interface{}
+	Schedule Schedule
+
+	next time.Time
+}
+
+// DefaultMaxInterval is the MaxInterval of a beat that doesn't set one.
+const DefaultMaxInterval = 5 * time.Minute
+
+// RetryInterval is how long after a failed send the entry is sent again.
+const RetryInterval = 5 * time.Second
+
+// Beat sends the tasks of its entries when they are due.
+type Beat struct {
+	context.Context
+	Sender Sender
+	Store  Store
+
+	// MaxInterval caps the time between checks of the entries,
+	// DefaultMaxInterval if not positive
+	MaxInterval time.Duration
+
+	tomb    *tomb.Tomb
+	mu      sync.Mutex
+	entries []*Entry
+	now     func() time.Time
+	// wake makes the run loop check the entries before its timer is due
+	wake chan struct{}
+}
+
+// NewBeat returns a beat keeping the last runs in store, in memory if nil.
+func NewBeat(ctx context.Context, sender Sender, store Store) *Beat {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	return &Beat{
+		Context:     ctx,
+		Sender:      sender,
+		Store:       store,
+		MaxInterval: DefaultMaxInterval,
+		tomb:        new(tomb.Tomb),
+		now:         time.Now,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Add schedules an entry. An entry that was due while beat wasn't running
+// is sent once straight away.
+func (b *Beat) Add(e *Entry) error {
+	if e.Name == "" || e.Task == "" {
+		return errors.New("beat: Entry name and task required")
+	}
+	if e.Schedule == nil {
+		return fmt.Errorf("beat: Entry %q has no schedule", e.Name)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, existing := range b.entries {
+		if existing.Name == e.Name {
+			return fmt.Errorf("beat: Entry %q already added", e.Name)
+		}
+	}
+
+	last, ok := b.Store.LastRun(e.Name)
+	if !ok {
+		last = b.now()
+	}
+	e.next = e.Schedule.Next(last)
+	b.entries = append(b.entries, e)
+
+	// The entry may be due before the run loop would wake up
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (b *Beat) Run() error {
+	b.tomb.Go(b.run)
+	return nil
+}
+
+func (b *Beat) Wait() error {
+	return b.tomb.Wait()
+}
+
+func (b *Beat) Stop() {
+	b.tomb.Kill(nil)
+}
+
+func (b *Beat) run() error {
+	log.FromContext(b).Infoln("Beat started")
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			timer.Reset(b.tick(b.now()))
+		case <-b.wake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(b.tick(b.now()))
+		case <-b.tomb.Dying():
+			return nil
+		}
+	}
+}
+
+// tick sends the entries due at now, and returns how long until the next
+// one is.
+func (b *Beat) tick(now time.Time) time.Duration {
+	sleep := b.MaxInterval
+	if sleep <= 0 {
+		sleep = DefaultMaxInterval
+	}
+
+	b.mu.Lock()
+	var due []*Entry
+	for _, e := range b.entries {
+		if e.next.IsZero() {
+			// Never runs again
+			continue
+		}
+		next := e.next
+		if !next.After(now) {
+			due = append(due, e)
+			// Runs missed while beat was down aren't caught up on, only
+			// the latest is sent. The entry stays due until it is.
+			next = e.Schedule.Next(now)
+			if next.IsZero() {
+				continue
+			}
+		}
+		if d := next.Sub(now); d < sleep {
+			sleep = d
+		}
+	}
+	b.mu.Unlock()
+
+	// Sent without the lock, so that a slow broker doesn't hold up Add
+	for _, e := range due {
+		if !b.send(e, now) {
+			if RetryInterval < sleep {
+				sleep = RetryInterval
+			}
+			continue
+		}
+		b.mu.Lock()
+		e.next = e.Schedule.Next(now)
+		b.mu.Unlock()
+	}
+	return sleep
+}
+
+// send sends the task of an entry, and reports whether it did.
+func (b *Beat) send(e *Entry, now time.Time) bool {
+	req, err := b.Sender.SendTask(e.Task, e.Args, e.KWArgs)
+	if err != nil {
+		log.FromContext(b).Errorf("Entry %q errored, retrying in %s: %s", e.Name, RetryInterval, err)
+		return false
+	}
+	log.FromContext(b).Infof("Entry %q sent %s[%s]", e.Name, req.TaskName, req.ID)
+
+	if err := b.Store.SetLastRun(e.Name, now); err != nil {
+		log.FromContext(b).Errorf("Entry %q last run store errored: %s", e.Name, err)
+	}
+	return true
+}
@@ -0,0 +1,188 @@
+package beat
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jianyuan/nori/message"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type fakeSender struct {
+	sent []string
+}
+
+func (s *fakeSender) SendTask(name string, _ []interface{}, _ map[string]interface{}) (*message.Request, error) {
+	s.sent = append(s.sent, name)
+	req := message.NewRequest()
+	req.TaskName = name
+	return req, nil
+}
+
+func TestBeat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beat")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schedule.json")
+
+	start := time.Date(2020, 3, 4, 10, 0, 30, 0, time.UTC)
+	newBeat := func(now time.Time) (*Beat, *fakeSender) {
+		store, err := NewFileStore(path)
+		require.NoError(t, err)
+		sender := &fakeSender{}
+		b := NewBeat(context.Background(), sender, store)
+		b.now = func() time.Time { return now }
+
+		hourly, err := NewCrontab("0", "*", "*", "*", "*")
+		require.NoError(t, err)
+		require.NoError(t, b.Add(&Entry{Name: "hourly", Task: "tasks.report", Schedule: hourly}))
+		require.NoError(t, b.Add(&Entry{Name: "often", Task: "tasks.ping", Schedule: Every(10 * time.Second)}))
+		return b, sender
+	}
+
+	b, sender := newBeat(start)
+	require.Error(t, b.Add(&Entry{Name: "often", Task: "tasks.ping", Schedule: Every(time.Second)}))
+	require.Equal(t, 10*time.Second, b.tick(start))
+	require.Empty(t, sender.sent)
+	require.Equal(t, 10*time.Second, b.tick(start.Add(10*time.Second)))
+	require.Equal(t, []string{"tasks.ping"}, sender.sent)
+
+	sender.sent = nil
+	b.tick(start.Add(59*time.Minute + 30*time.Second))
+	require.Equal(t, []string{"tasks.report", "tasks.ping"}, sender.sent)
+
+	// Restarted after missing two hourly runs, only one is sent, and the
+	// ping isn't sent again before it's due
+	restart := start.Add(3 * time.Hour)
+	b, sender = newBeat(restart)
+	b.tick(restart)
+	require.Equal(t, []string{"tasks.report", "tasks.ping"}, sender.sent)
+
+	b, sender = newBeat(restart.Add(time.Second))
+	require.Equal(t, 9*time.Second, b.tick(restart.Add(time.Second)))
+	require.Empty(t, sender.sent)
+}
+
+// addingSender adds an entry to the beat while sending, as a sender that
+// schedules follow-up tasks would.
+type addingSender struct {
+	fakeSender
+	b *Beat
+}
+
+func (s *addingSender) SendTask(name string, args []interface{}, kwargs map[string]interface{}) (*message.Request, error) {
+	if len(s.sent) == 0 {
+		if err := s.b.Add(&Entry{Name: "followup", Task: "tasks.followup", Schedule: Every(time.Minute)}); err != nil {
+			return nil, err
+		}
+	}
+	return s.fakeSender.SendTask(name, args, kwargs)
+}
+
+func TestBeatTick(t *testing.T) {
+	start := time.Date(2020, 3, 4, 10, 0, 30, 0, time.UTC)
+	sender := &addingSender{}
+	b := NewBeat(context.Background(), sender, nil)
+	sender.b = b
+	b.now = func() time.Time { return start }
+	require.NoError(t, b.Add(&Entry{Name: "often", Task: "tasks.ping", Schedule: Every(10 * time.Second)}))
+
+	// Entries are sent without holding the lock
+	done := make(chan time.Duration)
+	go func() { done <- b.tick(start.Add(10 * time.Second)) }()
+	select {
+	case sleep := <-done:
+		require.Equal(t, 10*time.Second, sleep)
+	case <-time.After(time.Second):
+		t.Fatal("Tick deadlocked")
+	}
+	require.Equal(t, []string{"tasks.ping"}, sender.sent)
+	require.Len(t, b.entries, 2)
+
+	// Without entries due, the beat sleeps for the max interval
+	b = NewBeat(context.Background(), &fakeSender{}, nil)
+	require.Equal(t, DefaultMaxInterval, b.tick(start))
+	b.MaxInterval = time.Minute
+	require.Equal(t, time.Minute, b.tick(start))
+	b.MaxInterval = 0
+	require.Equal(t, DefaultMaxInterval, b.tick(start))
+}
+
+// failingSender fails to send the given number of times before sending.
+type failingSender struct {
+	fakeSender
+	failures int
+}
+
+func (s *failingSender) SendTask(name string, args []interface{}, kwargs map[string]interface{}) (*message.Request, error) {
+	if s.failures > 0 {
+		s.failures--
+		return nil, errors.New("broker unreachable")
+	}
+	return s.fakeSender.SendTask(name, args, kwargs)
+}
+
+func TestBeatSendFailure(t *testing.T) {
+	start := time.Date(2020, 3, 4, 10, 0, 30, 0, time.UTC)
+	sender := &failingSender{failures: 1}
+	b := NewBeat(context.Background(), sender, nil)
+	b.now = func() time.Time { return start }
+	hourly, err := NewCrontab("0", "*", "*", "*", "*")
+	require.NoError(t, err)
+	require.NoError(t, b.Add(&Entry{Name: "hourly", Task: "tasks.report", Schedule: hourly}))
+
+	// A failed run isn't skipped, it's retried shortly
+	due := start.Add(59*time.Minute + 30*time.Second)
+	require.Equal(t, RetryInterval, b.tick(due))
+	require.Empty(t, sender.sent)
+	_, ok := b.Store.LastRun("hourly")
+	require.False(t, ok)
+
+	retry := due.Add(RetryInterval)
+	require.Equal(t, DefaultMaxInterval, b.tick(retry))
+	require.Equal(t, []string{"tasks.report"}, sender.sent)
+	last, ok := b.Store.LastRun("hourly")
+	require.True(t, ok)
+	require.Equal(t, retry, last)
+}
+
+// signallingSender passes the names of the tasks sent on.
+type signallingSender struct {
+	sent chan string
+}
+
+func (s *signallingSender) SendTask(name string, _ []interface{}, _ map[string]interface{}) (*message.Request, error) {
+	s.sent <- name
+	req := message.NewRequest()
+	req.TaskName = name
+	return req, nil
+}
+
+func TestBeatAddWakes(t *testing.T) {
+	sender := &signallingSender{sent: make(chan string, 1)}
+	b := NewBeat(context.Background(), sender, nil)
+	b.MaxInterval = time.Hour
+	require.NoError(t, b.Run())
+	defer func() {
+		b.Stop()
+		require.NoError(t, b.Wait())
+	}()
+
+	// Let the beat go to sleep without entries
+	time.Sleep(20 * time.Millisecond)
+
+	// Missed while beat wasn't running, so due straight away
+	require.NoError(t, b.Store.SetLastRun("hourly", time.Now().Add(-2*time.Hour)))
+	require.NoError(t, b.Add(&Entry{Name: "hourly", Task: "tasks.report", Schedule: Every(time.Hour)}))
+	select {
+	case name := <-sender.sent:
+		require.Equal(t, "tasks.report", name)
+	case <-time.After(time.Second):
+		t.Fatal("Added entry not sent")
+	}
+}
@@ -0,0 +1,137 @@
+package beat
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// crontabHorizon bounds the search for the next run, so that schedules
+// that never match, such as February 30th, end.
+const crontabHorizon = 5 * 366 * 24 * time.Hour
+
+var (
+	dayNames = map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}
+	monthNames = map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}
+)
+
+// Crontab runs a task at the times matching all of its fields, in Celery's
+// crontab syntax: "*", "*/15", "0,30", "1-5", "mon-fri" or "1-10/2".
+// Sunday is day 0 of the week.
+type Crontab struct {
+	// Location the fields are evaluated in, UTC if nil
+	Location *time.Location
+
+	minute, hour, dayOfWeek, dayOfMonth, monthOfYear uint64
+}
+
+func NewCrontab(minute, hour, dayOfWeek, dayOfMonth, monthOfYear string) (*Crontab, error) {
+	var c Crontab
+	var err error
+	if c.minute, err = parseCronField(minute, 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("beat: Invalid minute: %s", err)
+	}
+	if c.hour, err = parseCronField(hour, 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("beat: Invalid hour: %s", err)
+	}
+	if c.dayOfWeek, err = parseCronField(dayOfWeek, 0, 6, dayNames); err != nil {
+		return nil, fmt.Errorf("beat: Invalid day of week: %s", err)
+	}
+	if c.dayOfMonth, err = parseCronField(dayOfMonth, 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("beat: Invalid day of month: %s", err)
+	}
+	if c.monthOfYear, err = parseCronField(monthOfYear, 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("beat: Invalid month of year: %s", err)
+	}
+	return &c, nil
+}
+
+// parseCronField returns the set of values matched by a field, as bits.
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(strings.ToLower(field), ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = parseCronValue(bounds[0], names); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = parseCronValue(bounds[1], names); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// "5/15" starts at 5 and goes on to the end
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func parseCronValue(s string, names map[string]int) (int, error) {
+	if v, ok := names[s]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad value %q", s)
+	}
+	return v, nil
+}
+
+func matches(set uint64, v int) bool {
+	return set&(1<<uint(v)) != 0
+}
+
+// Next returns the first matching minute after last.
+func (c *Crontab) Next(last time.Time) time.Time {
+	loc := c.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	t := last.In(loc).Truncate(time.Minute).Add(time.Minute)
+	end := t.Add(crontabHorizon)
+	for t.Before(end) {
+		year, month, day := t.Date()
+		switch {
+		case !matches(c.monthOfYear, int(month)):
+			t = time.Date(year, month+1, 1, 0, 0, 0, 0, loc)
+		case !matches(c.dayOfMonth, day) || !matches(c.dayOfWeek, int(t.Weekday())):
+			t = time.Date(year, month, day+1, 0, 0, 0, 0, loc)
+		case !matches(c.hour, t.Hour()):
+			t = time.Date(year, month, day, t.Hour()+1, 0, 0, 0, loc)
+		case !matches(c.minute, t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
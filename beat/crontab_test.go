@@ -0,0 +1,43 @@
+package beat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCrontabNext(t *testing.T) {
+	date := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02 15:04", s)
+		require.NoError(t, err)
+		return d
+	}
+
+	tests := []struct {
+		minute, hour, dayOfWeek, dayOfMonth, monthOfYear string
+		last, next                                       string
+	}{
+		{"*", "*", "*", "*", "*", "2020-03-04 10:15", "2020-03-04 10:16"},
+		{"*/15", "*", "*", "*", "*", "2020-03-04 10:15", "2020-03-04 10:30"},
+		{"0", "9-17/4", "*", "*", "*", "2020-03-04 13:00", "2020-03-04 17:00"},
+		{"30", "7", "mon-fri", "*", "*", "2020-03-06 08:00", "2020-03-09 07:30"},
+		{"0", "0", "*", "1", "jan,jul", "2020-03-04 10:15", "2020-07-01 00:00"},
+		{"0", "0", "*", "29", "2", "2021-01-01 00:00", "2024-02-29 00:00"},
+		{"0", "0", "sun", "13", "*", "2020-01-01 00:00", "2020-09-13 00:00"},
+	}
+	for _, test := range tests {
+		c, err := NewCrontab(test.minute, test.hour, test.dayOfWeek, test.dayOfMonth, test.monthOfYear)
+		require.NoError(t, err)
+		require.Equal(t, date(test.next), c.Next(date(test.last)), "%+v", test)
+	}
+
+	c, err := NewCrontab("0", "0", "*", "30", "feb")
+	require.NoError(t, err)
+	require.True(t, c.Next(date("2020-01-01 00:00")).IsZero())
+
+	for _, field := range []string{"60", "*/0", "5-1", "foo", ""} {
+		_, err := NewCrontab(field, "*", "*", "*", "*")
+		require.Error(t, err, field)
+	}
+}
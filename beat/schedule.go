@@ -0,0 +1,27 @@
+// Package beat publishes tasks periodically, like Celery beat, on interval,
+// crontab and solar schedules.
+package beat
+
+import "time"
+
+// Schedule tells when a task runs next.
+type Schedule interface {
+	// Next returns the first run after last, or the zero time if there is
+	// none.
+	Next(last time.Time) time.Time
+}
+
+// Interval runs a task every so often.
+type Interval time.Duration
+
+// Every returns a schedule running a task every d.
+func Every(d time.Duration) Interval {
+	return Interval(d)
+}
+
+func (i Interval) Next(last time.Time) time.Time {
+	if i <= 0 {
+		return time.Time{}
+	}
+	return last.Add(time.Duration(i))
+}
@@ -0,0 +1,122 @@
+package beat
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Solar events, as named by Celery
+const (
+	Sunrise          = "sunrise"
+	Sunset           = "sunset"
+	SolarNoon        = "solar_noon"
+	DawnAstronomical = "dawn_astronomical"
+	DawnNautical     = "dawn_nautical"
+	DawnCivil        = "dawn_civil"
+	DuskAstronomical = "dusk_astronomical"
+	DuskNautical     = "dusk_nautical"
+	DuskCivil        = "dusk_civil"
+)
+
+const (
+	julianUnixEpoch = 2440587.5 // Julian day of 1970-01-01
+	julian2000      = 2451545.0 // Julian day of 2000-01-01 12:00 UTC
+	earthObliquity  = 23.4397   // Degrees
+
+	// Days searched for the next event
+	solarSearchDays = 366
+)
+
+// solarEvents gives the elevation of the sun at each event, and whether it
+// is rising then
+var solarEvents = map[string]struct {
+	elevation float64
+	rising    bool
+}{
+	Sunrise:          {-0.833, true},
+	Sunset:           {-0.833, false},
+	SolarNoon:        {90, true},
+	DawnAstronomical: {-18, true},
+	DawnNautical:     {-12, true},
+	DawnCivil:        {-6, true},
+	DuskAstronomical: {-18, false},
+	DuskNautical:     {-12, false},
+	DuskCivil:        {-6, false},
+}
+
+// Solar runs a task at a solar event at a place on earth. Near the poles,
+// events may not happen for months.
+type Solar struct {
+	Event     string
+	Latitude  float64
+	Longitude float64 // east of Greenwich
+}
+
+func NewSolar(event string, latitude, longitude float64) (*Solar, error) {
+	if _, ok := solarEvents[event]; !ok {
+		return nil, fmt.Errorf("beat: Unknown solar event %q", event)
+	}
+	if latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+		return nil, fmt.Errorf("beat: Invalid coordinates %g, %g", latitude, longitude)
+	}
+	return &Solar{
+		Event:     event,
+		Latitude:  latitude,
+		Longitude: longitude,
+	}, nil
+}
+
+// Next returns the first occurrence of the event after last.
+func (s *Solar) Next(last time.Time) time.Time {
+	day := last.UTC().Truncate(24 * time.Hour)
+	for i := -1; i <= solarSearchDays; i++ {
+		t, ok := s.on(day.AddDate(0, 0, i))
+		if ok && t.After(last) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// on returns the time of the event around noon of the given UTC day, with
+// the sunrise equation.
+func (s *Solar) on(day time.Time) (time.Time, bool) {
+	event := solarEvents[s.Event]
+
+	n := math.Floor(toJulian(day) + 0.5 - julian2000 + 0.0008)
+	meanNoon := n - s.Longitude/360
+	anomaly := math.Mod(357.5291+0.98560028*meanNoon, 360)
+	center := 1.9148*sin(anomaly) + 0.02*sin(2*anomaly) + 0.0003*sin(3*anomaly)
+	longitude := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := julian2000 + meanNoon + 0.0053*sin(anomaly) - 0.0069*sin(2*longitude)
+	if s.Event == SolarNoon {
+		return fromJulian(transit), true
+	}
+
+	declination := math.Asin(sin(longitude) * sin(earthObliquity))
+	cosHourAngle := (sin(event.elevation) - sin(s.Latitude)*math.Sin(declination)) /
+		(cos(s.Latitude) * math.Cos(declination))
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		// The sun stays above or below the elevation all day
+		return time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) * 180 / math.Pi
+
+	if event.rising {
+		return fromJulian(transit - hourAngle/360), true
+	}
+	return fromJulian(transit + hourAngle/360), true
+}
+
+func sin(degrees float64) float64 { return math.Sin(degrees * math.Pi / 180) }
+
+func cos(degrees float64) float64 { return math.Cos(degrees * math.Pi / 180) }
+
+func toJulian(t time.Time) float64 {
+	return float64(t.Unix())/86400 + julianUnixEpoch
+}
+
+func fromJulian(j float64) time.Time {
+	return time.Unix(0, int64((j-julianUnixEpoch)*86400*float64(time.Second))).UTC()
+}
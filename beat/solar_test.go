@@ -0,0 +1,37 @@
+package beat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSolarNext(t *testing.T) {
+	// London, at the summer solstice of 2020
+	last := time.Date(2020, 6, 21, 0, 0, 0, 0, time.UTC)
+	within := func(expected, actual time.Time) {
+		require.WithinDuration(t, expected, actual, 2*time.Minute)
+	}
+
+	sunrise, err := NewSolar(Sunrise, 51.5074, -0.1278)
+	require.NoError(t, err)
+	within(time.Date(2020, 6, 21, 3, 43, 0, 0, time.UTC), sunrise.Next(last))
+
+	sunset, err := NewSolar(Sunset, 51.5074, -0.1278)
+	require.NoError(t, err)
+	within(time.Date(2020, 6, 21, 20, 21, 0, 0, time.UTC), sunset.Next(last))
+
+	// The next day once the event is past
+	within(time.Date(2020, 6, 22, 3, 43, 0, 0, time.UTC), sunrise.Next(sunrise.Next(last)))
+
+	// No astronomical dusk in London until mid July
+	dusk, err := NewSolar(DuskAstronomical, 51.5074, -0.1278)
+	require.NoError(t, err)
+	next := dusk.Next(last)
+	require.Equal(t, time.July, next.Month())
+	require.True(t, next.Day() > 10, next)
+
+	_, err = NewSolar("moonrise", 0, 0)
+	require.Error(t, err)
+}
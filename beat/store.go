@@ -0,0 +1,120 @@
+package beat
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Store keeps the last run of each entry, so that a restarted beat neither
+// runs entries again nor skips those it missed.
+type Store interface {
+	LastRun(name string) (time.Time, bool)
+	SetLastRun(name string, t time.Time) error
+}
+
+// MemoryStore keeps last runs in memory only.
+type MemoryStore struct {
+	mu   sync.Mutex
+	runs map[string]time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		runs: make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryStore) LastRun(name string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.runs[name]
+	return t, ok
+}
+
+func (s *MemoryStore) SetLastRun(name string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runs[name] = t
+	return nil
+}
+
+// FileStore keeps last runs in a JSON file, which is replaced atomically
+// on every run.
+type FileStore struct {
+	MemoryStore
+	path string
+}
+
+// NewFileStore loads the last runs from path, if it exists.
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		MemoryStore: MemoryStore{runs: make(map[string]time.Time)},
+		path:        path,
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.runs); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileStore) SetLastRun(name string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.runs[name] = t
+	data, err := json.Marshal(s.runs)
+	if err != nil {
+		return err
+	}
+
+	// Synced before the rename, so that a crash leaves either the old file
+	// or the new one complete
+	tmp := s.path + ".tmp"
+	if err := writeFileSync(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(s.path))
+	return nil
+}
+
+func writeFileSync(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir makes a rename within dir durable. Directories can't be synced
+// everywhere, e.g. on Windows, so it is done on a best effort basis.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,92 @@
+package nori
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+
+	"github.com/jianyuan/nori/events"
+	"github.com/jianyuan/nori/log"
+	"github.com/jianyuan/nori/message"
+	"github.com/jianyuan/nori/transport"
+)
+
+// Client sends tasks to workers.
+type Client struct {
+	context.Context
+	Transport  transport.Driver
+	Exchange   string
+	RoutingKey string
+
+	// Priority of the tasks sent with SendTask
+	Priority uint8
+
+	// Events, if set, sends a task-sent event for every task sent
+	Events *events.Dispatcher
+}
+
+func NewClient(ctx context.Context, t transport.Driver) (*Client, error) {
+	if err := t.Init(ctx); err != nil {
+		return nil, fmt.Errorf("Transport init error: %s", err)
+	}
+	if err := t.Setup(); err != nil {
+		return nil, fmt.Errorf("Transport setup error: %s", err)
+	}
+
+	return &Client{
+		Context:    ctx,
+		Transport:  t,
+		Exchange:   "celery",
+		RoutingKey: "celery",
+	}, nil
+}
+
+// SendTask sends a request for the named task and returns it.
+func (c *Client) SendTask(name string, args []interface{}, kwargs map[string]interface{}) (*message.Request, error) {
+	id, err := message.NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	req := message.NewRequest()
+	req.TaskName = name
+	req.ID = id
+	req.Args = args
+	if kwargs != nil {
+		req.KWArgs = kwargs
+	}
+	req.IsUTC = true
+	req.Priority = c.Priority
+
+	if err := c.Send(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (c *Client) Send(req *message.Request) error {
+	if err := c.Transport.Publish(c.Exchange, c.RoutingKey, req); err != nil {
+		return err
+	}
+
+	err := c.Events.Send("task-sent", map[string]interface{}{
+		"uuid":        req.ID,
+		"name":        req.TaskName,
+		"args":        events.Repr(req.Args),
+		"kwargs":      events.Repr(req.KWArgs),
+		"retries":     req.Retries,
+		"eta":         formatTime(req.ETA),
+		"expires":     formatTime(req.ExpiresAt),
+		"queue":       c.RoutingKey,
+		"exchange":    c.Exchange,
+		"routing_key": c.RoutingKey,
+	})
+	if err != nil {
+		log.FromContext(c).Warnln("Sending task-sent event errored:", err)
+	}
+	return nil
+}
+
+func (c *Client) Close() error {
+	return c.Transport.Close()
+}
@@ -0,0 +1,157 @@
+package nori
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jianyuan/nori/log"
+	"github.com/jianyuan/nori/message"
+	"github.com/jianyuan/nori/transport"
+)
+
+// consumerGroup merges the requests of the queues consumed from on a
+// connection. It is lost as soon as one of them stops unless cancelled.
+type consumerGroup struct {
+	reqChan chan *message.Request
+	lost    chan struct{}
+	once    sync.Once
+
+	// Consumer channels by queue, guarded by Server.muConsumers
+	queues map[string]<-chan *message.Request
+}
+
+func newConsumerGroup() *consumerGroup {
+	return &consumerGroup{
+		reqChan: make(chan *message.Request),
+		lost:    make(chan struct{}),
+		queues:  make(map[string]<-chan *message.Request),
+	}
+}
+
+func (g *consumerGroup) close() {
+	g.once.Do(func() {
+		close(g.lost)
+	})
+}
+
+// consumeQueues starts consuming from every queue on the current
+// connection.
+func (s *Server) consumeQueues() (*consumerGroup, error) {
+	g := newConsumerGroup()
+
+	s.muConsumers.Lock()
+	defer s.muConsumers.Unlock()
+	for _, queue := range s.queues {
+		if err := s.consumeQueue(g, queue); err != nil {
+			g.close()
+			return nil, err
+		}
+	}
+	s.consumers = g
+	return g, nil
+}
+
+func (s *Server) stopConsumers(g *consumerGroup) {
+	g.close()
+
+	s.muConsumers.Lock()
+	if s.consumers == g {
+		s.consumers = nil
+	}
+	s.muConsumers.Unlock()
+}
+
+// consumeQueue adds a queue to the group, s.muConsumers must be held.
+func (s *Server) consumeQueue(g *consumerGroup, queue string) error {
+	queueChan, err := s.config.Transport.Consume(queue)
+	if err != nil {
+		return fmt.Errorf("consuming %q: %s", queue, err)
+	}
+	g.queues[queue] = queueChan
+	log.FromContext(s).Infoln("Consuming from", queue)
+
+	go func() {
+		for req := range queueChan {
+			select {
+			case g.reqChan <- req:
+			case <-g.lost:
+				return
+			}
+		}
+
+		s.muConsumers.Lock()
+		cancelled := g.queues[queue] != queueChan
+		s.muConsumers.Unlock()
+		if !cancelled {
+			g.close()
+		}
+	}()
+	return nil
+}
+
+// Queues returns the names of the queues consumed from.
+func (s *Server) Queues() []string {
+	s.muConsumers.Lock()
+	defer s.muConsumers.Unlock()
+	return append([]string(nil), s.queues...)
+}
+
+// AddConsumer starts consuming from a queue, which is declared if needed.
+// It is consumed from after reconnecting as well.
+func (s *Server) AddConsumer(queue string) error {
+	if queue == "" {
+		return errors.New("No queue specified")
+	}
+
+	s.muConsumers.Lock()
+	defer s.muConsumers.Unlock()
+
+	if indexOf(s.queues, queue) >= 0 {
+		return fmt.Errorf("Already consuming from %q", queue)
+	}
+	if s.consumers != nil {
+		if err := s.consumeQueue(s.consumers, queue); err != nil {
+			return err
+		}
+	}
+	s.queues = append(s.queues, queue)
+	return nil
+}
+
+// CancelConsumer stops consuming from a queue. The requests already
+// received from it are still run.
+func (s *Server) CancelConsumer(queue string) error {
+	canceller, ok := s.config.Transport.(transport.Canceller)
+	if !ok {
+		return fmt.Errorf("%s doesn't support cancelling consumers", s.config.Transport.Name())
+	}
+
+	s.muConsumers.Lock()
+	defer s.muConsumers.Unlock()
+
+	i := indexOf(s.queues, queue)
+	if i < 0 {
+		return fmt.Errorf("Not consuming from %q", queue)
+	}
+	if g := s.consumers; g != nil {
+		queueChan := g.queues[queue]
+		delete(g.queues, queue)
+		if err := canceller.Cancel(queue); err != nil {
+			g.queues[queue] = queueChan
+			return err
+		}
+	}
+	s.queues = append(s.queues[:i], s.queues[i+1:]...)
+	log.FromContext(s).Infoln("Stopped consuming from", queue)
+	return nil
+}
+
+func indexOf(list []string, s string) int {
+	for i, item := range list {
+		if item == s {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,221 @@
+package nori
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jianyuan/nori/control"
+	"github.com/jianyuan/nori/events"
+	"github.com/jianyuan/nori/log"
+	"github.com/jianyuan/nori/message"
+)
+
+// setupControl registers the remote control commands workers answer, under
+// the names Celery uses.
+func (s *Server) setupControl(node *control.Node) {
+	node.OnError = func(err error) {
+		log.FromContext(s).Warnln("Remote control command errored:", err)
+	}
+
+	node.Register("ping", func(*control.Command) (interface{}, error) {
+		return map[string]string{"ok": "pong"}, nil
+	})
+	node.Register("stats", s.controlStats)
+	node.Register("active", func(*control.Command) (interface{}, error) {
+		return s.activeRequests(), nil
+	})
+	node.Register("scheduled", func(*control.Command) (interface{}, error) {
+		return s.scheduledRequests(), nil
+	})
+	node.Register("reserved", func(*control.Command) (interface{}, error) {
+		reqs := s.queue.Requests()
+		infos := make([]map[string]interface{}, len(reqs))
+		for i, req := range reqs {
+			infos[i] = s.requestInfo(req, nil)
+		}
+		return infos, nil
+	})
+	node.Register("registered", func(*control.Command) (interface{}, error) {
+		names := make([]string, 0, len(s.Tasks))
+		for name := range s.Tasks {
+			names = append(names, name)
+		}
+		return names, nil
+	})
+	node.Register("revoked", func(*control.Command) (interface{}, error) {
+		return s.revoked.List(), nil
+	})
+	node.Register("revoke", s.controlRevoke)
+	node.Register("rate_limit", s.controlRateLimit)
+	node.Register("time_limit", s.controlTimeLimit)
+	node.Register("add_consumer", func(cmd *control.Command) (interface{}, error) {
+		queue := cmd.StringArg("queue")
+		if err := s.AddConsumer(queue); err != nil {
+			return nil, err
+		}
+		return map[string]string{"ok": fmt.Sprintf("add consumer %s", queue)}, nil
+	})
+	node.Register("cancel_consumer", func(cmd *control.Command) (interface{}, error) {
+		queue := cmd.StringArg("queue")
+		if err := s.CancelConsumer(queue); err != nil {
+			return nil, err
+		}
+		return map[string]string{"ok": fmt.Sprintf("no longer consuming from %s", queue)}, nil
+	})
+	node.Register("active_queues", func(*control.Command) (interface{}, error) {
+		queues := s.Queues()
+		infos := make([]map[string]interface{}, len(queues))
+		for i, queue := range queues {
+			infos[i] = map[string]interface{}{
+				"name":        queue,
+				"routing_key": queue,
+				"durable":     true,
+			}
+		}
+		return infos, nil
+	})
+	node.Register("shutdown", func(*control.Command) (interface{}, error) {
+		log.FromContext(s).Warnln("Shutdown requested remotely")
+		go s.Stop()
+		return control.NoReply, nil
+	})
+}
+
+func (s *Server) controlStats(*control.Command) (interface{}, error) {
+	totals := make(map[string]int64)
+	s.metrics.totals.Do(func(kv expvar.KeyValue) {
+		if count, ok := kv.Value.(*expvar.Int); ok {
+			totals[kv.Key] = count.Value()
+		}
+	})
+
+	s.muPrefetch.Lock()
+	prefetch := s.prefetch
+	s.muPrefetch.Unlock()
+
+	return map[string]interface{}{
+		"total": totals,
+		"pid":   os.Getpid(),
+		"pool": map[string]interface{}{
+			"max-concurrency": s.config.Concurrency,
+			"processes":       []int{os.Getpid()},
+		},
+		"prefetch_count": prefetch,
+		"broker": map[string]interface{}{
+			"transport": s.config.Transport.Name(),
+		},
+		"uptime":   int(time.Since(s.started).Seconds()),
+		"sw_ident": "nori",
+		"sw_ver":   Version,
+	}, nil
+}
+
+// controlRevoke revokes one task ID or a list of them. Running tasks can't
+// be terminated, terminate is ignored.
+func (s *Server) controlRevoke(cmd *control.Command) (interface{}, error) {
+	var ids []string
+	switch taskID := cmd.Arguments["task_id"].(type) {
+	case string:
+		ids = []string{taskID}
+	case []interface{}:
+		for _, id := range taskID {
+			if id, ok := id.(string); ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("No task ID specified")
+	}
+
+	for _, id := range ids {
+		s.revoked.Add(id)
+	}
+	log.FromContext(s).Infoln("Tasks revoked:", ids)
+	return map[string]string{"ok": fmt.Sprintf("tasks %v flagged as revoked", ids)}, nil
+}
+
+func (s *Server) controlRateLimit(cmd *control.Command) (interface{}, error) {
+	task, ok := s.Tasks[cmd.StringArg("task_name")]
+	if !ok {
+		return nil, fmt.Errorf("Unknown task %q", cmd.StringArg("task_name"))
+	}
+
+	var rate string
+	switch v := cmd.Arguments["rate_limit"].(type) {
+	case string:
+		rate = v
+	case float64:
+		rate = fmt.Sprint(v)
+	}
+	if err := task.SetRateLimit(rate); err != nil {
+		return nil, err
+	}
+	if rate == "" || rate == "0" {
+		return map[string]string{"ok": "rate limit disabled successfully"}, nil
+	}
+	return map[string]string{"ok": "new rate limit set successfully"}, nil
+}
+
+func (s *Server) controlTimeLimit(cmd *control.Command) (interface{}, error) {
+	task, ok := s.Tasks[cmd.StringArg("task_name")]
+	if !ok {
+		return nil, fmt.Errorf("Unknown task %q", cmd.StringArg("task_name"))
+	}
+	task.SetTimeLimits(cmd.DurationArg("soft"), cmd.DurationArg("hard"))
+	return map[string]string{"ok": "time limits set successfully"}, nil
+}
+
+func (s *Server) activeRequests() []map[string]interface{} {
+	s.muActive.Lock()
+	defer s.muActive.Unlock()
+
+	infos := make([]map[string]interface{}, 0, len(s.active))
+	for req, a := range s.active {
+		start := a.start
+		infos = append(infos, s.requestInfo(req, &start))
+	}
+	return infos
+}
+
+func (s *Server) scheduledRequests() []map[string]interface{} {
+	s.muScheduled.Lock()
+	defer s.muScheduled.Unlock()
+
+	infos := make([]map[string]interface{}, 0, len(s.scheduled))
+	for req := range s.scheduled {
+		infos = append(infos, map[string]interface{}{
+			"eta":      formatTime(req.ETA),
+			"priority": req.Priority,
+			"request":  s.requestInfo(req, nil),
+		})
+	}
+	return infos
+}
+
+// requestInfo describes a request the way Celery workers do in replies.
+func (s *Server) requestInfo(req *message.Request, start *time.Time) map[string]interface{} {
+	info := map[string]interface{}{
+		"id":           req.ID,
+		"name":         req.TaskName,
+		"type":         req.TaskName,
+		"args":         events.Repr(req.Args),
+		"kwargs":       events.Repr(req.KWArgs),
+		"hostname":     s.config.Hostname,
+		"time_start":   nil,
+		"acknowledged": start != nil,
+		"delivery_info": map[string]interface{}{
+			"exchange":    req.Exchange,
+			"routing_key": req.RoutingKey,
+			"priority":    req.Priority,
+		},
+		"worker_pid": os.Getpid(),
+	}
+	if start != nil {
+		info["time_start"] = events.Timestamp(*start)
+	}
+	return info
+}
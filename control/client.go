@@ -0,0 +1,329 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jianyuan/nori/message"
+	"github.com/jianyuan/nori/transport"
+	"golang.org/x/net/context"
+)
+
+// DefaultTimeout is how long replies are collected for by default, the same
+// as `celery inspect`.
+const DefaultTimeout = time.Second
+
+// ReplyError is the error a worker replied to a command with.
+type ReplyError struct {
+	Hostname string
+	Message  string
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("control: %s replied: %s", e.Hostname, e.Message)
+}
+
+// Replies holds the replies to a command by worker hostname.
+type Replies map[string]json.RawMessage
+
+// Decode decodes the reply of a worker into v, or returns a *ReplyError if
+// the worker replied with an error.
+func (r Replies) Decode(hostname string, v interface{}) error {
+	raw, ok := r[hostname]
+	if !ok {
+		return fmt.Errorf("control: No reply from %s", hostname)
+	}
+
+	var replyErr struct {
+		Error *string `json:"error"`
+	}
+	if json.Unmarshal(raw, &replyErr) == nil && replyErr.Error != nil {
+		return &ReplyError{Hostname: hostname, Message: *replyErr.Error}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// Client broadcasts commands to workers and collects their replies.
+type Client struct {
+	// Timeout is how long replies are collected for, DefaultTimeout if 0
+	Timeout time.Duration
+
+	broadcaster transport.Broadcaster
+	id          string
+
+	mu         sync.Mutex
+	subscribed bool
+	pending    map[string]chan Replies
+}
+
+func NewClient(b transport.Broadcaster) (*Client, error) {
+	id, err := message.NewID()
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		broadcaster: b,
+		id:          id,
+		pending:     make(map[string]chan Replies),
+	}, nil
+}
+
+// Broadcast sends a command to the given workers, or to all of them if
+// there is no destination. Unless reply is false, the replies received
+// within the timeout are returned, early once every destination replied.
+func (c *Client) Broadcast(method string, arguments map[string]interface{}, destination []string, reply bool) (Replies, error) {
+	if arguments == nil {
+		arguments = make(map[string]interface{})
+	}
+	cmd := &Command{
+		Method:      method,
+		Arguments:   arguments,
+		Destination: destination,
+	}
+	if !reply {
+		return nil, c.publish(cmd)
+	}
+
+	if err := c.subscribe(); err != nil {
+		return nil, err
+	}
+	ticket, err := message.NewID()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Ticket = ticket
+	cmd.ReplyTo = &ReplyTo{
+		Exchange:   ReplyExchange.Name,
+		RoutingKey: c.id,
+	}
+
+	replyChan := make(chan Replies, 16)
+	c.mu.Lock()
+	c.pending[ticket] = replyChan
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, ticket)
+		c.mu.Unlock()
+	}()
+
+	if err := c.publish(cmd); err != nil {
+		return nil, err
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	replies := make(Replies)
+	for {
+		select {
+		case r := <-replyChan:
+			for hostname, raw := range r {
+				replies[hostname] = raw
+			}
+			if len(destination) > 0 && len(replies) >= len(destination) {
+				return replies, nil
+			}
+		case <-timer.C:
+			return replies, nil
+		}
+	}
+}
+
+func (c *Client) publish(cmd *Command) error {
+	body, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	return c.broadcaster.PublishRaw(Exchange, "", &transport.RawMessage{
+		ContentType: ContentType,
+		Body:        body,
+	})
+}
+
+// subscribe starts collecting replies, keyed by the ID of the client, unless
+// it already does.
+func (c *Client) subscribe() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subscribed {
+		return nil
+	}
+
+	// Replies are collected for as long as the client is used
+	msgChan, err := c.broadcaster.Subscribe(context.Background(), ReplyExchange, c.id)
+	if err != nil {
+		return err
+	}
+	c.subscribed = true
+
+	go func() {
+		for msg := range msgChan {
+			c.dispatch(msg)
+		}
+
+		// Subscribe again on the next command
+		c.mu.Lock()
+		c.subscribed = false
+		c.mu.Unlock()
+	}()
+	return nil
+}
+
+func (c *Client) dispatch(msg *transport.RawMessage) {
+	ticket, _ := msg.Headers["ticket"].(string)
+
+	c.mu.Lock()
+	replyChan, ok := c.pending[ticket]
+	c.mu.Unlock()
+	if !ok {
+		// Late reply to a command no longer waited for
+		return
+	}
+
+	var r Replies
+	if err := json.Unmarshal(msg.Body, &r); err != nil {
+		return
+	}
+	select {
+	case replyChan <- r:
+	default:
+	}
+}
+
+// Ping returns the hostnames of the workers that replied to a ping.
+func (c *Client) Ping(destination ...string) ([]string, error) {
+	replies, err := c.Broadcast("ping", nil, destination, true)
+	if err != nil {
+		return nil, err
+	}
+
+	hostnames := make([]string, 0, len(replies))
+	for hostname := range replies {
+		if replies.Decode(hostname, nil) == nil {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	return hostnames, nil
+}
+
+// Stats are the statistics a worker replies to the stats command with.
+type Stats struct {
+	Total map[string]int64 `json:"total"`
+	PID   int              `json:"pid"`
+	Pool  struct {
+		MaxConcurrency int   `json:"max-concurrency"`
+		Processes      []int `json:"processes"`
+	} `json:"pool"`
+	PrefetchCount int `json:"prefetch_count"`
+	Broker        struct {
+		Transport string `json:"transport"`
+	} `json:"broker"`
+	Uptime  int    `json:"uptime"`
+	SWIdent string `json:"sw_ident"`
+	SWVer   string `json:"sw_ver"`
+}
+
+// Stats returns the statistics of the workers by hostname.
+func (c *Client) Stats(destination ...string) (map[string]*Stats, error) {
+	replies, err := c.Broadcast("stats", nil, destination, true)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]*Stats, len(replies))
+	for hostname := range replies {
+		var s Stats
+		if err := replies.Decode(hostname, &s); err != nil {
+			return nil, err
+		}
+		stats[hostname] = &s
+	}
+	return stats, nil
+}
+
+// TaskInfo describes a task request held by a worker, as replied to the
+// active and reserved commands.
+type TaskInfo struct {
+	ID           string                 `json:"id"`
+	Name         string                 `json:"name"`
+	Args         string                 `json:"args"`
+	KWArgs       string                 `json:"kwargs"`
+	Hostname     string                 `json:"hostname"`
+	TimeStart    *float64               `json:"time_start"`
+	Acknowledged bool                   `json:"acknowledged"`
+	DeliveryInfo map[string]interface{} `json:"delivery_info"`
+	WorkerPID    int                    `json:"worker_pid"`
+}
+
+// Active returns the tasks being run by the workers, by hostname.
+func (c *Client) Active(destination ...string) (map[string][]*TaskInfo, error) {
+	replies, err := c.Broadcast("active", nil, destination, true)
+	if err != nil {
+		return nil, err
+	}
+
+	active := make(map[string][]*TaskInfo, len(replies))
+	for hostname := range replies {
+		var infos []*TaskInfo
+		if err := replies.Decode(hostname, &infos); err != nil {
+			return nil, err
+		}
+		active[hostname] = infos
+	}
+	return active, nil
+}
+
+// Revoke makes the workers discard the given tasks when they receive them.
+func (c *Client) Revoke(ids []string, destination ...string) error {
+	return c.okCommand("revoke", map[string]interface{}{"task_id": ids}, destination)
+}
+
+// RateLimit changes the rate limit of a task, e.g. "10/s".
+func (c *Client) RateLimit(taskName, rate string, destination ...string) error {
+	return c.okCommand("rate_limit", map[string]interface{}{
+		"task_name":  taskName,
+		"rate_limit": rate,
+	}, destination)
+}
+
+// AddConsumer makes the workers consume from a queue.
+func (c *Client) AddConsumer(queue string, destination ...string) error {
+	return c.okCommand("add_consumer", map[string]interface{}{"queue": queue}, destination)
+}
+
+// CancelConsumer makes the workers stop consuming from a queue, e.g. to
+// drain them before a shutdown. Tasks already received still run.
+func (c *Client) CancelConsumer(queue string, destination ...string) error {
+	return c.okCommand("cancel_consumer", map[string]interface{}{"queue": queue}, destination)
+}
+
+// Shutdown asks the workers to shut down. Workers don't reply to it.
+func (c *Client) Shutdown(destination ...string) error {
+	_, err := c.Broadcast("shutdown", nil, destination, false)
+	return err
+}
+
+// okCommand broadcasts a command and returns the first error replied, if
+// any.
+func (c *Client) okCommand(method string, arguments map[string]interface{}, destination []string) error {
+	replies, err := c.Broadcast(method, arguments, destination, true)
+	if err != nil {
+		return err
+	}
+	for hostname := range replies {
+		if err := replies.Decode(hostname, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
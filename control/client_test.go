@@ -0,0 +1,70 @@
+package control
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jianyuan/nori/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	b := newFakeBroadcaster()
+	c, err := NewClient(b)
+	require.NoError(t, err)
+	c.Timeout = time.Second
+
+	type result struct {
+		stats map[string]*Stats
+		err   error
+	}
+	done := make(chan result)
+	go func() {
+		stats, err := c.Stats("a@host", "b@host")
+		done <- result{stats, err}
+	}()
+
+	p := b.next(t)
+	require.Equal(t, Exchange, p.exchange)
+	var cmd Command
+	require.NoError(t, json.Unmarshal(p.msg.Body, &cmd))
+	require.Equal(t, "stats", cmd.Method)
+	require.Equal(t, []string{"a@host", "b@host"}, cmd.Destination)
+	require.Equal(t, ReplyExchange.Name, cmd.ReplyTo.Exchange)
+
+	reply := func(ticket, body string) {
+		b.subscriptions[ReplyExchange.Name] <- &transport.RawMessage{
+			ContentType: ContentType,
+			Headers:     map[string]interface{}{"ticket": ticket},
+			Body:        []byte(body),
+		}
+	}
+	reply("other", `{"c@host": {}}`)
+	reply(cmd.Ticket, `{"a@host": {"total": {"tasks.add": 3}, "uptime": 10}}`)
+	reply(cmd.Ticket, `{"b@host": {"total": {}, "uptime": 20}}`)
+
+	// Returns before the timeout, as every destination replied
+	select {
+	case r := <-done:
+		require.NoError(t, r.err)
+		require.Len(t, r.stats, 2)
+		require.Equal(t, int64(3), r.stats["a@host"].Total["tasks.add"])
+		require.Equal(t, 20, r.stats["b@host"].Uptime)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Stats didn't return")
+	}
+}
+
+func TestRepliesDecode(t *testing.T) {
+	replies := Replies{
+		"a@host": json.RawMessage(`{"ok": "pong"}`),
+		"b@host": json.RawMessage(`{"error": "boom"}`),
+	}
+
+	var ok map[string]string
+	require.NoError(t, replies.Decode("a@host", &ok))
+	require.Equal(t, "pong", ok["ok"])
+	require.Equal(t, &ReplyError{Hostname: "b@host", Message: "boom"}, replies.Decode("b@host", nil))
+	require.Error(t, replies.Decode("c@host", nil))
+}
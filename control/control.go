@@ -0,0 +1,73 @@
+// Package control implements Celery's remote control protocol, with which
+// commands are broadcast to workers through the pidbox exchange.
+package control
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jianyuan/nori/transport"
+)
+
+const ContentType = "application/json"
+
+var (
+	// Exchange is the fanout exchange commands are broadcast to.
+	Exchange = transport.Exchange{
+		Name:    "celery.pidbox",
+		Kind:    "fanout",
+		Durable: false,
+	}
+
+	// ReplyExchange is the exchange workers reply to commands through.
+	ReplyExchange = transport.Exchange{
+		Name:    "reply.celery.pidbox",
+		Kind:    "direct",
+		Durable: false,
+	}
+)
+
+var ErrUnknownMethod = errors.New("control: No such method")
+
+// Command is a remote control command, as sent by `celery control` and
+// `celery inspect`.
+type Command struct {
+	Method      string                 `json:"method"`
+	Arguments   map[string]interface{} `json:"arguments"`
+	Destination []string               `json:"destination"`
+	Pattern     *string                `json:"pattern"`
+	Matcher     *string                `json:"matcher"`
+	ReplyTo     *ReplyTo               `json:"reply_to,omitempty"`
+	Ticket      string                 `json:"ticket,omitempty"`
+}
+
+// ReplyTo tells where replies to a command are expected.
+type ReplyTo struct {
+	Exchange   string `json:"exchange"`
+	RoutingKey string `json:"routing_key"`
+}
+
+// For tells whether the command is meant for the given host.
+func (c *Command) For(hostname string) bool {
+	if len(c.Destination) == 0 {
+		return true
+	}
+	for _, dest := range c.Destination {
+		if dest == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+// StringArg returns a string argument, or "" if it is missing.
+func (c *Command) StringArg(key string) string {
+	s, _ := c.Arguments[key].(string)
+	return s
+}
+
+// DurationArg returns an argument given in seconds, or 0 if it is missing.
+func (c *Command) DurationArg(key string) time.Duration {
+	seconds, _ := c.Arguments[key].(float64)
+	return time.Duration(seconds * float64(time.Second))
+}
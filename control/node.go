@@ -0,0 +1,105 @@
+package control
+
+import (
+	"encoding/json"
+
+	"github.com/jianyuan/nori/transport"
+	"golang.org/x/net/context"
+)
+
+// Handler runs a command and returns its reply. An error is replied as
+// {"error": message}.
+type Handler func(cmd *Command) (interface{}, error)
+
+// NoReply is returned by handlers of commands that aren't replied to, such
+// as shutdown.
+var NoReply interface{} = noReply{}
+
+type noReply struct{}
+
+// Node answers the commands sent to a worker.
+type Node struct {
+	Hostname string
+
+	// OnError, if set, is called with the errors of handling commands
+	OnError func(error)
+
+	broadcaster transport.Broadcaster
+	handlers    map[string]Handler
+}
+
+func NewNode(b transport.Broadcaster, hostname string) *Node {
+	return &Node{
+		Hostname:    hostname,
+		broadcaster: b,
+		handlers:    make(map[string]Handler),
+	}
+}
+
+// Register sets the handler of a method.
+func (n *Node) Register(method string, h Handler) {
+	n.handlers[method] = h
+}
+
+// Listen subscribes to the pidbox exchange and handles commands until ctx is
+// done or the connection to the broker is lost.
+func (n *Node) Listen(ctx context.Context) error {
+	msgChan, err := n.broadcaster.Subscribe(ctx, Exchange, "")
+	if err != nil {
+		return err
+	}
+	go func() {
+		for msg := range msgChan {
+			if err := n.handle(msg); err != nil && n.OnError != nil {
+				n.OnError(err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (n *Node) handle(msg *transport.RawMessage) error {
+	var cmd Command
+	if err := json.Unmarshal(msg.Body, &cmd); err != nil {
+		return err
+	}
+	if !cmd.For(n.Hostname) {
+		return nil
+	}
+
+	reply := n.Dispatch(&cmd)
+	if reply == NoReply || cmd.ReplyTo == nil {
+		return nil
+	}
+	return n.reply(&cmd, reply)
+}
+
+// Dispatch runs a command and returns its reply.
+func (n *Node) Dispatch(cmd *Command) interface{} {
+	h, ok := n.handlers[cmd.Method]
+	if !ok {
+		return map[string]interface{}{"error": ErrUnknownMethod.Error() + ": " + cmd.Method}
+	}
+	reply, err := h(cmd)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+	return reply
+}
+
+func (n *Node) reply(cmd *Command, reply interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{n.Hostname: reply})
+	if err != nil {
+		return err
+	}
+
+	exchange := ReplyExchange
+	if cmd.ReplyTo.Exchange != "" {
+		exchange.Name = cmd.ReplyTo.Exchange
+	}
+	return n.broadcaster.PublishRaw(exchange, cmd.ReplyTo.RoutingKey, &transport.RawMessage{
+		ContentType: ContentType,
+		Headers:     map[string]interface{}{"ticket": cmd.Ticket},
+		Body:        body,
+	})
+}
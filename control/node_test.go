@@ -0,0 +1,80 @@
+package control
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jianyuan/nori/transport"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type fakeBroadcaster struct {
+	transport.Broadcaster
+	subscriptions map[string]chan *transport.RawMessage
+	published     chan published
+}
+
+type published struct {
+	exchange transport.Exchange
+	key      string
+	msg      *transport.RawMessage
+}
+
+func newFakeBroadcaster() *fakeBroadcaster {
+	return &fakeBroadcaster{
+		subscriptions: make(map[string]chan *transport.RawMessage),
+		published:     make(chan published, 16),
+	}
+}
+
+func (b *fakeBroadcaster) PublishRaw(exchange transport.Exchange, key string, msg *transport.RawMessage) error {
+	b.published <- published{exchange, key, msg}
+	return nil
+}
+
+func (b *fakeBroadcaster) Subscribe(ctx context.Context, exchange transport.Exchange, key string) (<-chan *transport.RawMessage, error) {
+	ch := make(chan *transport.RawMessage, 16)
+	b.subscriptions[exchange.Name] = ch
+	return ch, nil
+}
+
+func (b *fakeBroadcaster) send(t *testing.T, exchange string, v interface{}) {
+	body, err := json.Marshal(v)
+	require.NoError(t, err)
+	b.subscriptions[exchange] <- &transport.RawMessage{ContentType: ContentType, Body: body}
+}
+
+func (b *fakeBroadcaster) next(t *testing.T) published {
+	select {
+	case p := <-b.published:
+		return p
+	case <-time.After(time.Second):
+		t.Fatal("Nothing published")
+		return published{}
+	}
+}
+
+func TestNode(t *testing.T) {
+	b := newFakeBroadcaster()
+	n := NewNode(b, "tasks@host")
+	n.Register("ping", func(*Command) (interface{}, error) {
+		return map[string]string{"ok": "pong"}, nil
+	})
+	require.NoError(t, n.Listen(context.Background()))
+
+	replyTo := &ReplyTo{Exchange: "reply.celery.pidbox", RoutingKey: "t1"}
+	b.send(t, Exchange.Name, &Command{Method: "ping", Destination: []string{"other@host"}, ReplyTo: replyTo, Ticket: "t1"})
+	b.send(t, Exchange.Name, &Command{Method: "ping", ReplyTo: replyTo, Ticket: "t2"})
+	b.send(t, Exchange.Name, &Command{Method: "unknown", ReplyTo: replyTo, Ticket: "t3"})
+
+	p := b.next(t)
+	require.Equal(t, ReplyExchange, p.exchange)
+	require.Equal(t, "t1", p.key)
+	require.Equal(t, "t2", p.msg.Headers["ticket"])
+	require.JSONEq(t, `{"tasks@host": {"ok": "pong"}}`, string(p.msg.Body))
+
+	p = b.next(t)
+	require.JSONEq(t, `{"tasks@host": {"error": "control: No such method: unknown"}}`, string(p.msg.Body))
+}
@@ -0,0 +1,189 @@
+package nori
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jianyuan/nori/control"
+	"github.com/jianyuan/nori/transport"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestControlStats(t *testing.T) {
+	s := newTestServer(t, &Configuration{})
+	s.metrics.totals.Add("tasks.add", 1)
+	s.metrics.totals.Add("tasks.add", 1)
+	s.metrics.totals.Add("tasks.mul", 1)
+
+	reply, err := s.controlStats(&control.Command{Method: "stats"})
+	require.NoError(t, err)
+
+	// Replies are sent as JSON
+	body, err := json.Marshal(reply)
+	require.NoError(t, err)
+	var stats control.Stats
+	require.NoError(t, json.Unmarshal(body, &stats))
+	require.Equal(t, map[string]int64{"tasks.add": 2, "tasks.mul": 1}, stats.Total)
+	require.Equal(t, 2, stats.Pool.MaxConcurrency)
+	require.Equal(t, "FakeTransport", stats.Broker.Transport)
+}
+
+func TestControlRevoke(t *testing.T) {
+	s := newTestServer(t, &Configuration{})
+
+	_, err := s.controlRevoke(&control.Command{Arguments: map[string]interface{}{"task_id": "a1"}})
+	require.NoError(t, err)
+	_, err = s.controlRevoke(&control.Command{Arguments: map[string]interface{}{
+		"task_id":   []interface{}{"b2", "c3"},
+		"terminate": true,
+	}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a1", "b2", "c3"}, s.revoked.List())
+
+	_, err = s.controlRevoke(&control.Command{Arguments: map[string]interface{}{}})
+	require.EqualError(t, err, "No task ID specified")
+	_, err = s.controlRevoke(&control.Command{Arguments: map[string]interface{}{"task_id": []interface{}{}}})
+	require.EqualError(t, err, "No task ID specified")
+}
+
+func TestControlRateLimit(t *testing.T) {
+	s := newTestServer(t, &Configuration{})
+	task := &Task{Name: "add"}
+	s.RegisterTask(task)
+
+	rateLimit := func(rate interface{}) (interface{}, error) {
+		return s.controlRateLimit(&control.Command{Arguments: map[string]interface{}{
+			"task_name":  "tasks.add",
+			"rate_limit": rate,
+		}})
+	}
+
+	reply, err := rateLimit("10/s")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"ok": "new rate limit set successfully"}, reply)
+	require.Equal(t, "10/s", task.RateLimit)
+	require.Equal(t, 100*time.Millisecond, task.limiter.interval)
+
+	// Numbers are per second
+	_, err = rateLimit(2.0)
+	require.NoError(t, err)
+	require.Equal(t, "2", task.RateLimit)
+	require.Equal(t, 500*time.Millisecond, task.limiter.interval)
+
+	reply, err = rateLimit("")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"ok": "rate limit disabled successfully"}, reply)
+	require.Equal(t, time.Duration(0), task.limiter.interval)
+
+	_, err = rateLimit("fast")
+	require.EqualError(t, err, `Invalid rate limit "fast"`)
+	require.Equal(t, "", task.RateLimit)
+
+	_, err = s.controlRateLimit(&control.Command{Arguments: map[string]interface{}{
+		"task_name":  "tasks.missing",
+		"rate_limit": "1/s",
+	}})
+	require.EqualError(t, err, `Unknown task "tasks.missing"`)
+}
+
+type subscription struct {
+	exchange transport.Exchange
+	key      string
+	msgChan  chan *transport.RawMessage
+}
+
+// broadcastingTransport routes raw messages to the subscriptions of their
+// exchange, to all of them for fanout exchanges and by routing key
+// otherwise.
+type broadcastingTransport struct {
+	*fakeTransport
+
+	muSubscriptions sync.Mutex
+	subscriptions   []*subscription
+}
+
+func (t *broadcastingTransport) PublishRaw(exchange transport.Exchange, key string, msg *transport.RawMessage) error {
+	t.muSubscriptions.Lock()
+	defer t.muSubscriptions.Unlock()
+	for _, sub := range t.subscriptions {
+		if sub.exchange.Name == exchange.Name && (exchange.Kind == "fanout" || sub.key == key) {
+			sub.msgChan <- msg
+		}
+	}
+	return nil
+}
+
+func (t *broadcastingTransport) Subscribe(ctx context.Context, exchange transport.Exchange, key string) (<-chan *transport.RawMessage, error) {
+	t.muSubscriptions.Lock()
+	defer t.muSubscriptions.Unlock()
+	sub := &subscription{exchange, key, make(chan *transport.RawMessage, 16)}
+	t.subscriptions = append(t.subscriptions, sub)
+
+	if ctx.Done() != nil {
+		go func() {
+			<-ctx.Done()
+			t.muSubscriptions.Lock()
+			defer t.muSubscriptions.Unlock()
+			for i, s := range t.subscriptions {
+				if s == sub {
+					t.subscriptions = append(t.subscriptions[:i], t.subscriptions[i+1:]...)
+					break
+				}
+			}
+			close(sub.msgChan)
+		}()
+	}
+	return sub.msgChan, nil
+}
+
+func TestControlRoundTrip(t *testing.T) {
+	tr := &broadcastingTransport{fakeTransport: &fakeTransport{}}
+	s := newTestServer(t, &Configuration{Transport: tr, RemoteControl: true, Queues: []string{"celery"}})
+	s.RegisterTask(&Task{Name: "add"})
+	s.metrics.totals.Add("tasks.add", 3)
+	require.NoError(t, s.control.Listen(s))
+
+	c, err := control.NewClient(tr)
+	require.NoError(t, err)
+	c.Timeout = 200 * time.Millisecond
+
+	hostnames, err := c.Ping()
+	require.NoError(t, err)
+	require.Equal(t, []string{"tasks@test"}, hostnames)
+
+	stats, err := c.Stats("tasks@test")
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"tasks.add": 3}, stats["tasks@test"].Total)
+	require.Equal(t, 2, stats["tasks@test"].Pool.MaxConcurrency)
+	require.Equal(t, "nori", stats["tasks@test"].SWIdent)
+
+	req, _ := newTestRequest("a1")
+	s.muActive.Lock()
+	s.active[req] = &activeRequest{start: time.Now()}
+	s.muActive.Unlock()
+	active, err := c.Active("tasks@test")
+	require.NoError(t, err)
+	require.Len(t, active["tasks@test"], 1)
+	info := active["tasks@test"][0]
+	require.Equal(t, "a1", info.ID)
+	require.Equal(t, "tasks.add", info.Name)
+	require.True(t, info.Acknowledged)
+	require.NotNil(t, info.TimeStart)
+	require.Equal(t, "celery", info.DeliveryInfo["routing_key"])
+
+	require.NoError(t, c.Revoke([]string{"b2"}, "tasks@test"))
+	require.True(t, s.revoked.Contains("b2"))
+
+	require.NoError(t, c.RateLimit("tasks.add", "10/s", "tasks@test"))
+	require.Equal(t, "10/s", s.Tasks["tasks.add"].RateLimit)
+	err = c.RateLimit("tasks.missing", "10/s", "tasks@test")
+	require.Equal(t, &control.ReplyError{Hostname: "tasks@test", Message: `Unknown task "tasks.missing"`}, err)
+
+	// Commands for other workers are ignored
+	hostnames, err = c.Ping("other@test")
+	require.NoError(t, err)
+	require.Empty(t, hostnames)
+}
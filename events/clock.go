@@ -0,0 +1,35 @@
+package events
+
+import "sync"
+
+// Clock is a Lamport clock, which orders the events of a cluster without
+// relying on synchronized wall clocks.
+type Clock struct {
+	mu    sync.Mutex
+	value int64
+}
+
+// Forward advances the clock for an event about to be sent.
+func (c *Clock) Forward() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.value++
+	return c.value
+}
+
+// Adjust moves the clock past the clock of an event that was received.
+func (c *Clock) Adjust(other int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if other > c.value {
+		c.value = other
+	}
+	c.value++
+	return c.value
+}
+
+func (c *Clock) Value() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.value
+}
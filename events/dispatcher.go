@@ -0,0 +1,65 @@
+package events
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/jianyuan/nori/transport"
+)
+
+// Exchange is the topic exchange events are published to.
+var Exchange = transport.Exchange{
+	Name:    ExchangeName,
+	Kind:    "topic",
+	Durable: true,
+}
+
+// Dispatcher sends events from a host. A nil Dispatcher sends nothing, so
+// that events can be disabled by not creating one.
+type Dispatcher struct {
+	Hostname string
+	Clock    *Clock
+
+	broadcaster transport.Broadcaster
+}
+
+func NewDispatcher(b transport.Broadcaster, hostname string) *Dispatcher {
+	return &Dispatcher{
+		Hostname:    hostname,
+		Clock:       new(Clock),
+		broadcaster: b,
+	}
+}
+
+// Send publishes an event of the given type with the given fields, to which
+// the fields common to all events are added.
+func (d *Dispatcher) Send(eventType string, fields map[string]interface{}) error {
+	if d == nil {
+		return nil
+	}
+
+	now := time.Now()
+	_, offset := now.Zone()
+
+	e := make(Event, len(fields)+6)
+	for k, v := range fields {
+		e[k] = v
+	}
+	e["type"] = eventType
+	e["hostname"] = d.Hostname
+	e["timestamp"] = Timestamp(now)
+	e["clock"] = d.Clock.Forward()
+	e["utcoffset"] = -offset / 3600
+	e["pid"] = os.Getpid()
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return d.broadcaster.PublishRaw(Exchange, RoutingKey(eventType), &transport.RawMessage{
+		ContentType: ContentType,
+		Headers:     map[string]interface{}{"hostname": d.Hostname},
+		Body:        body,
+	})
+}
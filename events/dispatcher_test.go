@@ -0,0 +1,57 @@
+package events
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jianyuan/nori/transport"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeBroadcaster struct {
+	transport.Broadcaster
+	exchange transport.Exchange
+	key      string
+	msg      *transport.RawMessage
+}
+
+func (b *fakeBroadcaster) PublishRaw(exchange transport.Exchange, key string, msg *transport.RawMessage) error {
+	b.exchange, b.key, b.msg = exchange, key, msg
+	return nil
+}
+
+func TestDispatcherSend(t *testing.T) {
+	b := &fakeBroadcaster{}
+	d := NewDispatcher(b, "tasks@host")
+
+	require.NoError(t, d.Send("task-succeeded", map[string]interface{}{
+		"uuid":    "a1",
+		"result":  Repr(3),
+		"runtime": 0.5,
+	}))
+	require.Equal(t, Exchange, b.exchange)
+	require.Equal(t, "task.succeeded", b.key)
+	require.Equal(t, ContentType, b.msg.ContentType)
+
+	var e Event
+	require.NoError(t, json.Unmarshal(b.msg.Body, &e))
+	require.Equal(t, "task-succeeded", e.Type())
+	require.Equal(t, "tasks@host", e.Hostname())
+	require.Equal(t, "a1", e.UUID())
+	require.Equal(t, "3", e["result"])
+	require.Equal(t, int64(1), e.Clock())
+	require.True(t, e.IsTaskEvent())
+	require.False(t, e.Timestamp().IsZero())
+
+	// Disabled
+	var disabled *Dispatcher
+	require.NoError(t, disabled.Send("task-sent", nil))
+}
+
+func TestClock(t *testing.T) {
+	var c Clock
+	require.Equal(t, int64(1), c.Forward())
+	require.Equal(t, int64(11), c.Adjust(10))
+	require.Equal(t, int64(12), c.Adjust(3))
+	require.Equal(t, int64(12), c.Value())
+}
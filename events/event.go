@@ -0,0 +1,91 @@
+// Package events sends and receives Celery events, through which monitors
+// such as Flower follow tasks and workers.
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Exchange and content type of Celery events
+const (
+	ExchangeName = "celeryev"
+	ContentType  = "application/json"
+)
+
+// Event is a Celery event, a set of fields of which "type" tells the kind,
+// e.g. "task-succeeded" or "worker-heartbeat".
+type Event map[string]interface{}
+
+func (e Event) Type() string {
+	t, _ := e["type"].(string)
+	return t
+}
+
+func (e Event) Hostname() string {
+	hostname, _ := e["hostname"].(string)
+	return hostname
+}
+
+// UUID returns the ID of the task a task event is about.
+func (e Event) UUID() string {
+	uuid, _ := e["uuid"].(string)
+	return uuid
+}
+
+func (e Event) Clock() int64 {
+	return int64(e.Float("clock"))
+}
+
+// Timestamp returns when the event was sent.
+func (e Event) Timestamp() time.Time {
+	return FromTimestamp(e.Float("timestamp"))
+}
+
+// Float returns a numeric field, or 0 if it is missing.
+func (e Event) Float(key string) float64 {
+	switch v := e[key].(type) {
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	default:
+		return 0
+	}
+}
+
+// IsTaskEvent tells whether the event is about a task rather than a worker.
+func (e Event) IsTaskEvent() bool {
+	return strings.HasPrefix(e.Type(), "task-")
+}
+
+// RoutingKey returns the key events of the given type are published with,
+// e.g. "task.succeeded" for "task-succeeded".
+func RoutingKey(eventType string) string {
+	return strings.Replace(eventType, "-", ".", -1)
+}
+
+// Timestamp converts a time to seconds since the epoch, as used in events.
+func Timestamp(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+func FromTimestamp(ts float64) time.Time {
+	sec, frac := math.Modf(ts)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second)))
+}
+
+// Repr formats a value such as task arguments or results for an event, in
+// which Celery sends them as strings.
+func Repr(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
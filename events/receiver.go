@@ -0,0 +1,72 @@
+package events
+
+import (
+	"encoding/json"
+
+	"github.com/jianyuan/nori/transport"
+	"golang.org/x/net/context"
+)
+
+// Receiver consumes events from the celeryev exchange.
+type Receiver struct {
+	Clock *Clock
+
+	// Key selects the events received, e.g. "task.#" for task events only.
+	// Defaults to all of them.
+	Key string
+
+	broadcaster transport.Broadcaster
+}
+
+func NewReceiver(b transport.Broadcaster) *Receiver {
+	return &Receiver{
+		Clock:       new(Clock),
+		Key:         "#",
+		broadcaster: b,
+	}
+}
+
+// Receive subscribes to events until ctx is done. The channel is closed
+// then, or when the connection to the broker is lost, after which Receive
+// can be called again.
+func (r *Receiver) Receive(ctx context.Context) (<-chan Event, error) {
+	msgChan, err := r.broadcaster.Subscribe(ctx, Exchange, r.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	eventChan := make(chan Event)
+	go func() {
+		// The subscription ends with ctx as well
+		defer close(eventChan)
+
+		for {
+			var msg *transport.RawMessage
+			select {
+			case <-ctx.Done():
+				return
+			case m, ok := <-msgChan:
+				if !ok {
+					return
+				}
+				msg = m
+			}
+
+			if msg.ContentType != ContentType {
+				continue
+			}
+			var e Event
+			if err := json.Unmarshal(msg.Body, &e); err != nil {
+				continue
+			}
+			r.Clock.Adjust(e.Clock())
+
+			select {
+			case <-ctx.Done():
+				return
+			case eventChan <- e:
+			}
+		}
+	}()
+	return eventChan, nil
+}
@@ -0,0 +1,74 @@
+package events
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jianyuan/nori/transport"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// subscribingBroadcaster hands out a single subscription fed by the test.
+type subscribingBroadcaster struct {
+	transport.Broadcaster
+	ctx     context.Context
+	key     string
+	msgChan chan *transport.RawMessage
+}
+
+func (b *subscribingBroadcaster) Subscribe(ctx context.Context, exchange transport.Exchange, key string) (<-chan *transport.RawMessage, error) {
+	b.ctx = ctx
+	b.key = key
+	return b.msgChan, nil
+}
+
+func eventMessage(t *testing.T, e Event) *transport.RawMessage {
+	body, err := json.Marshal(e)
+	require.NoError(t, err)
+	return &transport.RawMessage{ContentType: ContentType, Body: body}
+}
+
+func TestReceiverReceive(t *testing.T) {
+	b := &subscribingBroadcaster{msgChan: make(chan *transport.RawMessage)}
+	r := NewReceiver(b)
+	r.Key = "task.#"
+
+	eventChan, err := r.Receive(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "task.#", b.key)
+
+	b.msgChan <- &transport.RawMessage{ContentType: "application/x-python-serialize"}
+	b.msgChan <- eventMessage(t, Event{"type": "task-received", "uuid": "a1", "clock": 5.0})
+	e := <-eventChan
+	require.Equal(t, "a1", e.UUID())
+	require.Equal(t, int64(6), r.Clock.Value())
+
+	// The connection is lost
+	close(b.msgChan)
+	_, ok := <-eventChan
+	require.False(t, ok)
+}
+
+func TestReceiverReceiveDone(t *testing.T) {
+	b := &subscribingBroadcaster{msgChan: make(chan *transport.RawMessage)}
+	r := NewReceiver(b)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	eventChan, err := r.Receive(ctx)
+	require.NoError(t, err)
+
+	// An event nobody receives doesn't block the receiver once done
+	b.msgChan <- eventMessage(t, Event{"type": "worker-heartbeat"})
+	cancel()
+	select {
+	case _, ok := <-eventChan:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("Event channel not closed")
+	}
+
+	// The transport ends the subscription along with the receiver
+	require.Equal(t, context.Canceled, b.ctx.Err())
+}
@@ -0,0 +1,281 @@
+package events
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jianyuan/nori/message"
+)
+
+// Heartbeats may be late by up to this many times their interval before a
+// worker is considered offline, as in Celery.
+const heartbeatExpiry = 2
+
+// Worker is the state of a worker as told by its events.
+type Worker struct {
+	Hostname  string
+	Online    bool
+	Freq      float64 // heartbeat interval in seconds
+	SWIdent   string
+	SWVer     string
+	SWSys     string
+	Active    int
+	Processed int
+	LoadAvg   []float64
+	Heartbeat time.Time // of the last event
+}
+
+// Alive tells whether the worker is online and sent a heartbeat recently.
+func (w *Worker) Alive() bool {
+	if !w.Online {
+		return false
+	}
+	expiry := time.Duration(w.Freq * heartbeatExpiry * float64(time.Second))
+	return time.Since(w.Heartbeat) < expiry
+}
+
+// Task is the state of a task as told by its events.
+type Task struct {
+	UUID      string
+	Name      string
+	State     message.State
+	Hostname  string
+	Args      string
+	KWArgs    string
+	Retries   int
+	Result    string
+	Exception string
+	Traceback string
+	Runtime   float64
+
+	Sent      time.Time
+	Received  time.Time
+	Started   time.Time
+	Succeeded time.Time
+	Failed    time.Time
+	Retried   time.Time
+	Revoked   time.Time
+	Updated   time.Time // timestamp of the last event
+}
+
+// Ready tells whether the task is done, one way or another.
+func (t *Task) Ready() bool {
+	switch t.State {
+	case message.Success, message.Failure, message.Revoked:
+		return true
+	default:
+		return false
+	}
+}
+
+// State is the state of a cluster, built from the events it sends. Only the
+// most recent tasks are kept.
+type State struct {
+	MaxTasks    int
+	MaxFailures int
+
+	mu       sync.RWMutex
+	workers  map[string]*Worker
+	tasks    map[string]*Task
+	order    []string // task IDs, oldest first
+	failures []*Task  // most recent last
+}
+
+func NewState() *State {
+	return &State{
+		MaxTasks:    10000,
+		MaxFailures: 100,
+		workers:     make(map[string]*Worker),
+		tasks:       make(map[string]*Task),
+	}
+}
+
+// Consume applies events until the channel is closed.
+func (s *State) Consume(events <-chan Event) {
+	for e := range events {
+		s.Event(e)
+	}
+}
+
+// Event applies an event to the state.
+func (s *State) Event(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e.IsTaskEvent() {
+		s.taskEvent(e)
+	} else {
+		s.workerEvent(e)
+	}
+}
+
+func (s *State) workerEvent(e Event) {
+	hostname := e.Hostname()
+	if hostname == "" {
+		return
+	}
+	w, ok := s.workers[hostname]
+	if !ok {
+		w = &Worker{Hostname: hostname}
+		s.workers[hostname] = w
+	}
+
+	w.Online = e.Type() != "worker-offline"
+	w.Heartbeat = e.Timestamp()
+	w.Freq = e.Float("freq")
+	w.Active = int(e.Float("active"))
+	w.Processed = int(e.Float("processed"))
+	w.SWIdent, _ = e["sw_ident"].(string)
+	w.SWVer, _ = e["sw_ver"].(string)
+	w.SWSys, _ = e["sw_sys"].(string)
+	// Not reused, copies returned by Workers share it
+	w.LoadAvg = nil
+	loadavg, _ := e["loadavg"].([]interface{})
+	for _, v := range loadavg {
+		if v, ok := v.(float64); ok {
+			w.LoadAvg = append(w.LoadAvg, v)
+		}
+	}
+}
+
+func (s *State) taskEvent(e Event) {
+	uuid := e.UUID()
+	if uuid == "" {
+		return
+	}
+	t, ok := s.tasks[uuid]
+	if !ok {
+		t = &Task{UUID: uuid, State: message.Pending}
+		s.tasks[uuid] = t
+		s.order = append(s.order, uuid)
+		s.evict()
+	}
+
+	ts := e.Timestamp()
+	t.Updated = ts
+	if hostname := e.Hostname(); hostname != "" && e.Type() != "task-sent" {
+		t.Hostname = hostname
+	}
+
+	state := t.State
+	switch e.Type() {
+	case "task-sent":
+		t.Sent = ts
+		s.taskFields(t, e)
+	case "task-received":
+		t.Received = ts
+		state = message.Received
+		s.taskFields(t, e)
+	case "task-started":
+		t.Started = ts
+		state = message.Started
+	case "task-succeeded":
+		t.Succeeded = ts
+		state = message.Success
+		t.Result, _ = e["result"].(string)
+		t.Runtime = e.Float("runtime")
+	case "task-failed":
+		t.Failed = ts
+		state = message.Failure
+		t.Exception, _ = e["exception"].(string)
+		t.Traceback, _ = e["traceback"].(string)
+		s.failures = append(s.failures, t)
+		if len(s.failures) > s.MaxFailures {
+			s.failures = s.failures[len(s.failures)-s.MaxFailures:]
+		}
+	case "task-retried":
+		t.Retried = ts
+		state = message.Retry
+		t.Exception, _ = e["exception"].(string)
+		t.Traceback, _ = e["traceback"].(string)
+	case "task-revoked":
+		t.Revoked = ts
+		state = message.Revoked
+	default:
+		return
+	}
+
+	// Events may arrive out of order, a task that is done stays so
+	if !t.Ready() || state == message.Success || state == message.Failure || state == message.Revoked {
+		t.State = state
+	}
+}
+
+func (s *State) taskFields(t *Task, e Event) {
+	if name, ok := e["name"].(string); ok {
+		t.Name = name
+	}
+	if args, ok := e["args"].(string); ok {
+		t.Args = args
+	}
+	if kwargs, ok := e["kwargs"].(string); ok {
+		t.KWArgs = kwargs
+	}
+	t.Retries = int(e.Float("retries"))
+}
+
+// evict forgets the oldest tasks over MaxTasks.
+func (s *State) evict() {
+	for s.MaxTasks > 0 && len(s.order) > s.MaxTasks {
+		delete(s.tasks, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// Workers returns the workers seen, sorted by hostname.
+func (s *State) Workers() []Worker {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	workers := make([]Worker, 0, len(s.workers))
+	for _, w := range s.workers {
+		workers = append(workers, *w)
+	}
+	sort.Slice(workers, func(i, j int) bool { return workers[i].Hostname < workers[j].Hostname })
+	return workers
+}
+
+// Task returns the task with the given ID, if it is known.
+func (s *State) Task(uuid string) (Task, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.tasks[uuid]
+	if !ok {
+		return Task{}, false
+	}
+	return *t, true
+}
+
+// Tasks returns the known tasks, oldest first.
+func (s *State) Tasks() []Task {
+	return s.TasksByState(-1)
+}
+
+// TasksByState returns the known tasks in the given state, oldest first. A
+// negative state matches all tasks.
+func (s *State) TasksByState(state message.State) []Task {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var tasks []Task
+	for _, uuid := range s.order {
+		if t := s.tasks[uuid]; state < 0 || t.State == state {
+			tasks = append(tasks, *t)
+		}
+	}
+	return tasks
+}
+
+// RecentFailures returns the last tasks that failed, most recent last.
+func (s *State) RecentFailures() []Task {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tasks := make([]Task, len(s.failures))
+	for i, t := range s.failures {
+		tasks[i] = *t
+	}
+	return tasks
+}
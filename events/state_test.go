@@ -0,0 +1,75 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jianyuan/nori/message"
+	"github.com/stretchr/testify/require"
+)
+
+func testEvent(eventType string, fields map[string]interface{}) Event {
+	e := Event{
+		"type":      eventType,
+		"hostname":  "tasks@host",
+		"timestamp": Timestamp(time.Now()),
+	}
+	for k, v := range fields {
+		e[k] = v
+	}
+	return e
+}
+
+func TestStateTasks(t *testing.T) {
+	s := NewState()
+	s.Event(testEvent("task-received", map[string]interface{}{"uuid": "a1", "name": "tasks.add", "args": "[1,2]"}))
+	s.Event(testEvent("task-started", map[string]interface{}{"uuid": "a1"}))
+	s.Event(testEvent("task-succeeded", map[string]interface{}{"uuid": "a1", "result": "3", "runtime": 0.25}))
+	s.Event(testEvent("task-received", map[string]interface{}{"uuid": "b2", "name": "tasks.ping"}))
+	s.Event(testEvent("task-failed", map[string]interface{}{"uuid": "b2", "exception": "boom"}))
+
+	// Late event of a task that is done
+	s.Event(testEvent("task-started", map[string]interface{}{"uuid": "a1"}))
+
+	task, ok := s.Task("a1")
+	require.True(t, ok)
+	require.Equal(t, "tasks.add", task.Name)
+	require.Equal(t, message.Success, task.State)
+	require.Equal(t, "3", task.Result)
+	require.Equal(t, 0.25, task.Runtime)
+	require.Equal(t, "tasks@host", task.Hostname)
+
+	require.Len(t, s.Tasks(), 2)
+	failed := s.TasksByState(message.Failure)
+	require.Len(t, failed, 1)
+	require.Equal(t, "b2", failed[0].UUID)
+	require.Equal(t, failed, s.RecentFailures())
+
+	s.MaxTasks = 1
+	s.Event(testEvent("task-sent", map[string]interface{}{"uuid": "c3"}))
+	require.Len(t, s.Tasks(), 1)
+	_, ok = s.Task("a1")
+	require.False(t, ok)
+}
+
+func TestStateWorkers(t *testing.T) {
+	s := NewState()
+	s.Event(testEvent("worker-heartbeat", map[string]interface{}{
+		"freq":      2.0,
+		"active":    1.0,
+		"processed": 10.0,
+		"sw_ident":  "nori",
+		"loadavg":   []interface{}{0.5, 0.25, 0.1},
+	}))
+
+	workers := s.Workers()
+	require.Len(t, workers, 1)
+	require.Equal(t, "tasks@host", workers[0].Hostname)
+	require.Equal(t, 1, workers[0].Active)
+	require.Equal(t, 10, workers[0].Processed)
+	require.Equal(t, []float64{0.5, 0.25, 0.1}, workers[0].LoadAvg)
+	require.True(t, workers[0].Alive())
+
+	s.Event(testEvent("worker-offline", nil))
+	require.False(t, s.Workers()[0].Alive())
+}
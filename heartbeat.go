@@ -0,0 +1,61 @@
+package nori
+
+import (
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is reported by workers in their events.
+const Version = "0.1.0"
+
+// workerEvent sends a worker event with the fields monitors use to track
+// the load of the worker.
+func (s *Server) workerEvent(eventType string) {
+	s.sendEvent(eventType, map[string]interface{}{
+		"freq":      s.config.HeartbeatInterval.Seconds(),
+		"sw_ident":  "nori",
+		"sw_ver":    Version,
+		"sw_sys":    runtime.GOOS,
+		"active":    s.metrics.active.Value(),
+		"processed": s.metrics.processed.Value(),
+		"loadavg":   loadAverage(),
+	})
+}
+
+// heartbeat sends worker heartbeats until the server is stopped, so that
+// monitors consider the worker alive. None are sent while disconnected, the
+// worker-online event announces the worker again on reconnect.
+func (s *Server) heartbeat() error {
+	ticker := time.NewTicker(s.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if s.isConnected() {
+				s.workerEvent("worker-heartbeat")
+			}
+		case <-s.tomb.Dying():
+			return nil
+		}
+	}
+}
+
+// loadAverage returns the system load averages over 1, 5 and 15 minutes,
+// or zeros where they aren't available.
+func loadAverage() [3]float64 {
+	var avg [3]float64
+
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return avg
+	}
+	fields := strings.Fields(string(data))
+	for i := 0; i < len(avg) && i < len(fields); i++ {
+		avg[i], _ = strconv.ParseFloat(fields[i], 64)
+	}
+	return avg
+}
@@ -1,16 +1,25 @@
 package nori
 
 import (
+	"encoding/json"
 	"expvar"
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/jianyuan/nori/log"
+	"github.com/jianyuan/nori/transport"
 )
 
+// RunManagementServer serves the management endpoints and expvar on addr.
 func (s *Server) RunManagementServer(addr string) {
 	log.FromContext(s).Infoln("Management server listening on", addr)
 	s.setupExpvar()
-	go http.ListenAndServe(addr, nil)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", s.Handler())
+	mux.Handle("/debug/vars", expvar.Handler())
+	go http.ListenAndServe(addr, mux)
 }
 
 func (s *Server) setupExpvar() {
@@ -25,4 +34,150 @@ func (s *Server) setupExpvar() {
 		}
 		return tasks
 	}))
+
+	parentMap.Set("Connects", &s.metrics.connects)
+	parentMap.Set("ConnectionErrors", &s.metrics.connectionErrors)
+	parentMap.Set("ConnectionLosses", &s.metrics.connectionLosses)
+	parentMap.Set("Reconnects", &s.metrics.reconnects)
+	parentMap.Set("Active", &s.metrics.active)
+	parentMap.Set("Processed", &s.metrics.processed)
+}
+
+// Handler returns the management endpoints, for the caller to mount on a
+// server of their own. Purging queues is among them, so it shouldn't be
+// exposed publicly.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/queues", s.serveQueues)
+	mux.HandleFunc("/queues/", s.serveQueue)
+	mux.HandleFunc("/consumers", s.serveConsumers)
+	mux.HandleFunc("/consumers/", s.serveConsumer)
+	return mux
+}
+
+// InspectQueue returns the counts of the named queue.
+func (s *Server) InspectQueue(name string) (*transport.QueueStats, error) {
+	inspector, ok := s.config.Transport.(transport.QueueInspector)
+	if !ok {
+		return nil, fmt.Errorf("%s doesn't support queue inspection", s.config.Transport.Name())
+	}
+	return inspector.InspectQueue(name)
+}
+
+// PurgeQueue removes the messages waiting in the named queue and returns how
+// many there were.
+func (s *Server) PurgeQueue(name string) (int, error) {
+	inspector, ok := s.config.Transport.(transport.QueueInspector)
+	if !ok {
+		return 0, fmt.Errorf("%s doesn't support queue purging", s.config.Transport.Name())
+	}
+	n, err := inspector.PurgeQueue(name)
+	if err != nil {
+		return 0, err
+	}
+	log.FromContext(s).Infof("Purged %d messages from %q", n, name)
+	return n, nil
+}
+
+// serveQueues responds with the counts of the queues consumed from.
+func (s *Server) serveQueues(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	queues := s.Queues()
+	stats := make([]*transport.QueueStats, 0, len(queues))
+	for _, name := range queues {
+		queueStats, err := s.InspectQueue(name)
+		if err != nil {
+			queueError(w, err)
+			return
+		}
+		stats = append(stats, queueStats)
+	}
+	writeJSON(w, stats)
+}
+
+// serveQueue responds to GET /queues/<name> with the counts of the queue,
+// and to POST /queues/<name>/purge by purging it.
+func (s *Server) serveQueue(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/queues/")
+
+	switch {
+	case r.Method == "GET" && !strings.Contains(name, "/"):
+		stats, err := s.InspectQueue(name)
+		if err != nil {
+			queueError(w, err)
+			return
+		}
+		writeJSON(w, stats)
+
+	case r.Method == "POST" && strings.HasSuffix(name, "/purge"):
+		name = strings.TrimSuffix(name, "/purge")
+		n, err := s.PurgeQueue(name)
+		if err != nil {
+			queueError(w, err)
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"name":   name,
+			"purged": n,
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveConsumers responds with the names of the queues consumed from.
+func (s *Server) serveConsumers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.Queues())
+}
+
+// serveConsumer starts consuming from the queue on POST /consumers/<name>,
+// and stops on DELETE.
+func (s *Server) serveConsumer(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/consumers/")
+	if name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case "POST":
+		err = s.AddConsumer(name)
+	case "DELETE":
+		err = s.CancelConsumer(name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, s.Queues())
+}
+
+// queueError responds with the error of a queue operation, 404 if the queue
+// doesn't exist and 502 if the broker failed otherwise.
+func queueError(w http.ResponseWriter, err error) {
+	status := http.StatusBadGateway
+	if err == transport.ErrQueueNotFound {
+		status = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
@@ -0,0 +1,101 @@
+package nori
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jianyuan/nori/transport"
+	"github.com/stretchr/testify/require"
+)
+
+// inspectingTransport is a fakeTransport holding the message counts of its
+// queues.
+type inspectingTransport struct {
+	*fakeTransport
+	queues map[string]int
+}
+
+func (t *inspectingTransport) InspectQueue(name string) (*transport.QueueStats, error) {
+	n, ok := t.queues[name]
+	if !ok {
+		return nil, transport.ErrQueueNotFound
+	}
+	return &transport.QueueStats{Name: name, Messages: n, Consumers: 1}, nil
+}
+
+func (t *inspectingTransport) PurgeQueue(name string) (int, error) {
+	n, ok := t.queues[name]
+	if !ok {
+		return 0, transport.ErrQueueNotFound
+	}
+	t.queues[name] = 0
+	return n, nil
+}
+
+func serveManagement(t *testing.T, s *Server, method, path string, v interface{}) int {
+	req := httptest.NewRequest(method, path, nil)
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	if v != nil && rec.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+	}
+	return rec.Code
+}
+
+func TestManagementQueues(t *testing.T) {
+	tr := &inspectingTransport{
+		fakeTransport: &fakeTransport{},
+		queues:        map[string]int{"celery": 3, "priority": 1},
+	}
+	s := newTestServer(t, &Configuration{Transport: tr, Queues: []string{"celery", "priority"}})
+
+	var stats []*transport.QueueStats
+	require.Equal(t, http.StatusOK, serveManagement(t, s, "GET", "/queues", &stats))
+	require.Equal(t, []*transport.QueueStats{
+		{Name: "celery", Messages: 3, Consumers: 1},
+		{Name: "priority", Messages: 1, Consumers: 1},
+	}, stats)
+
+	var queueStats transport.QueueStats
+	require.Equal(t, http.StatusOK, serveManagement(t, s, "GET", "/queues/celery", &queueStats))
+	require.Equal(t, 3, queueStats.Messages)
+
+	require.Equal(t, http.StatusNotFound, serveManagement(t, s, "GET", "/queues/missing", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, serveManagement(t, s, "POST", "/queues", nil))
+
+	// A consumed queue that was deleted
+	delete(tr.queues, "priority")
+	require.Equal(t, http.StatusNotFound, serveManagement(t, s, "GET", "/queues", nil))
+
+	// Without queue inspection
+	s = newTestServer(t, &Configuration{Queues: []string{"celery"}})
+	require.Equal(t, http.StatusBadGateway, serveManagement(t, s, "GET", "/queues", nil))
+}
+
+func TestManagementPurgeQueue(t *testing.T) {
+	tr := &inspectingTransport{
+		fakeTransport: &fakeTransport{},
+		queues:        map[string]int{"celery": 3},
+	}
+	s := newTestServer(t, &Configuration{Transport: tr, Queues: []string{"celery"}})
+
+	var purged map[string]interface{}
+	require.Equal(t, http.StatusOK, serveManagement(t, s, "POST", "/queues/celery/purge", &purged))
+	require.Equal(t, map[string]interface{}{"name": "celery", "purged": 3.0}, purged)
+	require.Equal(t, 0, tr.queues["celery"])
+
+	require.Equal(t, http.StatusNotFound, serveManagement(t, s, "POST", "/queues/missing/purge", nil))
+	require.Equal(t, http.StatusNotFound, serveManagement(t, s, "GET", "/queues/celery/purge", nil))
+}
+
+func TestManagementHandlerIsolated(t *testing.T) {
+	s := newTestServer(t, &Configuration{})
+
+	// Servers have their own handlers, none on the default mux
+	s.Handler()
+	s.Handler()
+	_, pattern := http.DefaultServeMux.Handler(httptest.NewRequest("GET", "/queues", nil))
+	require.Empty(t, pattern)
+}
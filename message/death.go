@@ -0,0 +1,68 @@
+package message
+
+import "time"
+
+// Death describes an occasion on which a message was dead-lettered, as
+// recorded by RabbitMQ in the x-death header.
+type Death struct {
+	Queue       string
+	Reason      string // "rejected", "expired", "maxlen" or "delivery_limit"
+	Count       int64
+	Exchange    string
+	RoutingKeys []string
+	Time        time.Time
+}
+
+// Deaths returns the x-death entries of the request, most recent first.
+func (req *Request) Deaths() []Death {
+	entries, _ := req.Headers["x-death"].([]interface{})
+
+	deaths := make([]Death, 0, len(entries))
+	for _, entry := range entries {
+		fields, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		var d Death
+		d.Queue, _ = fields["queue"].(string)
+		d.Reason, _ = fields["reason"].(string)
+		d.Count, _ = fields["count"].(int64)
+		d.Exchange, _ = fields["exchange"].(string)
+		d.Time, _ = fields["time"].(time.Time)
+		keys, _ := fields["routing-keys"].([]interface{})
+		for _, key := range keys {
+			if key, ok := key.(string); ok {
+				d.RoutingKeys = append(d.RoutingKeys, key)
+			}
+		}
+		deaths = append(deaths, d)
+	}
+	return deaths
+}
+
+// DeadLetterReason returns why the request was last dead-lettered, or an
+// empty string if it never was.
+func (req *Request) DeadLetterReason() string {
+	if deaths := req.Deaths(); len(deaths) > 0 {
+		return deaths[0].Reason
+	}
+	reason, _ := req.Headers["x-first-death-reason"].(string)
+	return reason
+}
+
+// DeliveryCount returns how many times the request was delivered before, as
+// counted by quorum queues in the x-delivery-count header. A request that
+// keeps coming back likely makes its consumer crash.
+func (req *Request) DeliveryCount() int64 {
+	switch n := req.Headers["x-delivery-count"].(type) {
+	case int64:
+		return n
+	case int32:
+		return int64(n)
+	case int:
+		return int64(n)
+	default:
+		return 0
+	}
+}
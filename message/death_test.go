@@ -0,0 +1,52 @@
+package message
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestDeaths(t *testing.T) {
+	now := time.Now()
+	req := NewRequest()
+	require.Empty(t, req.Deaths())
+	require.Equal(t, "", req.DeadLetterReason())
+
+	req.Headers = map[string]interface{}{
+		"x-death": []interface{}{
+			map[string]interface{}{
+				"queue":        "celery.delay",
+				"reason":       "expired",
+				"count":        int64(1),
+				"exchange":     "",
+				"routing-keys": []interface{}{"celery.delay"},
+				"time":         now,
+			},
+			map[string]interface{}{
+				"queue":        "celery",
+				"reason":       "rejected",
+				"count":        int64(2),
+				"exchange":     "celery",
+				"routing-keys": []interface{}{"celery"},
+				"time":         now,
+			},
+		},
+	}
+	require.Equal(t, []Death{
+		{Queue: "celery.delay", Reason: "expired", Count: 1, RoutingKeys: []string{"celery.delay"}, Time: now},
+		{Queue: "celery", Reason: "rejected", Count: 2, Exchange: "celery", RoutingKeys: []string{"celery"}, Time: now},
+	}, req.Deaths())
+	require.Equal(t, "expired", req.DeadLetterReason())
+}
+
+func TestRequestDeliveryCount(t *testing.T) {
+	req := NewRequest()
+	require.Equal(t, int64(0), req.DeliveryCount())
+
+	req.Headers = map[string]interface{}{"x-delivery-count": int64(3)}
+	require.Equal(t, int64(3), req.DeliveryCount())
+
+	req.Headers = map[string]interface{}{"x-delivery-count": int32(4)}
+	require.Equal(t, int64(4), req.DeliveryCount())
+}
@@ -15,9 +15,46 @@ type Request struct {
 	ETA       *time.Time
 	ExpiresAt *time.Time
 	IsUTC     bool
+	Retries   int
+
+	// Priority of the request, higher ones run first
+	Priority uint8
 
 	ReplyTo *string
 	// TODO other celery fields
+
+	// Headers of the message the request was received in
+	Headers map[string]interface{}
+
+	// Exchange and RoutingKey the request was published with
+	Exchange   string
+	RoutingKey string
+
+	Acknowledger Acknowledger
+}
+
+// Acknowledger settles a request with the broker it was received from.
+type Acknowledger interface {
+	Ack() error
+	Reject(requeue bool) error
+}
+
+// Ack acknowledges the request to the broker. It is a no-op for transports
+// that don't need acknowledgements.
+func (req *Request) Ack() error {
+	if req.Acknowledger == nil {
+		return nil
+	}
+	return req.Acknowledger.Ack()
+}
+
+// Reject returns the request to the broker, which will requeue or discard
+// it.
+func (req *Request) Reject(requeue bool) error {
+	if req.Acknowledger == nil {
+		return nil
+	}
+	return req.Acknowledger.Reject(requeue)
 }
 
 func (req *Request) MustArg(pos int) interface{} {
@@ -1,7 +1,9 @@
 package protocol
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 
@@ -25,6 +27,20 @@ type CeleryTask struct {
 	ReplyTo    *string                `json:"-"`
 }
 
+func DecodeCeleryTask(contentType string, body []byte) (*CeleryTask, error) {
+	switch contentType {
+	case "application/json":
+		var t CeleryTask
+		if err := json.Unmarshal(body, &t); err != nil {
+			return nil, err
+		}
+		return &t, nil
+
+	default:
+		return nil, fmt.Errorf("protocol: unsupported content type %q", contentType)
+	}
+}
+
 func (t *CeleryTask) ToRequest() *message.Request {
 	return &message.Request{
 		TaskName:  t.Name,
@@ -34,10 +50,28 @@ func (t *CeleryTask) ToRequest() *message.Request {
 		ETA:       t.ETA,
 		ExpiresAt: t.ExpiresAt,
 		IsUTC:     t.IsUTC,
+		Retries:   t.Retries,
 		ReplyTo:   t.ReplyTo,
 	}
 }
 
+func NewCeleryTask(req *message.Request) (*CeleryTask, error) {
+	if req == nil {
+		return nil, errors.New("protocol: Request is nil")
+	}
+	return &CeleryTask{
+		Name:      req.TaskName,
+		ID:        req.ID,
+		Args:      req.Args,
+		KWArgs:    req.KWArgs,
+		ETA:       req.ETA,
+		ExpiresAt: req.ExpiresAt,
+		IsUTC:     req.IsUTC,
+		Retries:   req.Retries,
+		ReplyTo:   req.ReplyTo,
+	}, nil
+}
+
 type CeleryResult struct {
 	Status    string      `json:"status"`
 	Traceback *string     `json:"traceback"`
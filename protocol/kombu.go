@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// KombuMessage is the envelope kombu's virtual transports (filesystem,
+// SQLAlchemy, ...) use to store a message outside of an AMQP broker.
+type KombuMessage struct {
+	Body            string                 `json:"body"`
+	ContentEncoding string                 `json:"content-encoding"`
+	ContentType     string                 `json:"content-type"`
+	Headers         map[string]interface{} `json:"headers"`
+	Properties      KombuProperties        `json:"properties"`
+}
+
+type KombuProperties struct {
+	BodyEncoding  string            `json:"body_encoding"`
+	CorrelationID string            `json:"correlation_id,omitempty"`
+	ReplyTo       string            `json:"reply_to,omitempty"`
+	DeliveryMode  int               `json:"delivery_mode"`
+	DeliveryInfo  KombuDeliveryInfo `json:"delivery_info"`
+	DeliveryTag   string            `json:"delivery_tag"`
+	Priority      int               `json:"priority"`
+}
+
+type KombuDeliveryInfo struct {
+	Exchange   string `json:"exchange"`
+	RoutingKey string `json:"routing_key"`
+}
+
+func NewKombuMessage(contentType string, body []byte) *KombuMessage {
+	return &KombuMessage{
+		Body:            base64.StdEncoding.EncodeToString(body),
+		ContentEncoding: "utf-8",
+		ContentType:     contentType,
+		Headers:         make(map[string]interface{}),
+		Properties: KombuProperties{
+			BodyEncoding: "base64",
+			DeliveryMode: 2,
+		},
+	}
+}
+
+// DecodeBody returns the message body with its body encoding removed.
+func (m *KombuMessage) DecodeBody() ([]byte, error) {
+	switch m.Properties.BodyEncoding {
+	case "base64":
+		return base64.StdEncoding.DecodeString(m.Body)
+	case "":
+		return []byte(m.Body), nil
+	default:
+		return nil, fmt.Errorf("protocol: unsupported body encoding %q", m.Properties.BodyEncoding)
+	}
+}
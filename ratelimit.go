@@ -0,0 +1,83 @@
+package nori
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseRateLimit parses a Celery rate limit such as "10/s", "100/m" or
+// "1000/h" into the interval between two runs. A bare number is per second,
+// an empty string or 0 means no limit.
+func parseRateLimit(rate string) (time.Duration, error) {
+	if rate == "" {
+		return 0, nil
+	}
+
+	count, unit := rate, "s"
+	if i := strings.Index(rate, "/"); i >= 0 {
+		count, unit = rate[:i], rate[i+1:]
+	}
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid rate limit %q", rate)
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	var period time.Duration
+	switch unit {
+	case "s":
+		period = time.Second
+	case "m":
+		period = time.Minute
+	case "h":
+		period = time.Hour
+	default:
+		return 0, fmt.Errorf("Invalid rate limit %q", rate)
+	}
+	return time.Duration(float64(period) / n), nil
+}
+
+// rateLimiter spaces runs evenly so that they don't exceed a rate.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func (l *rateLimiter) SetInterval(interval time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.interval = interval
+}
+
+// Wait blocks until the next run is allowed, and returns false if cancel
+// is closed first.
+func (l *rateLimiter) Wait(cancel <-chan struct{}) bool {
+	l.mu.Lock()
+	if l.interval <= 0 {
+		l.mu.Unlock()
+		return true
+	}
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.mu.Unlock()
+
+	if !at.After(now) {
+		return true
+	}
+	select {
+	case <-time.After(at.Sub(now)):
+		return true
+	case <-cancel:
+		return false
+	}
+}
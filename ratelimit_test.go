@@ -0,0 +1,54 @@
+package nori
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	for rate, interval := range map[string]time.Duration{
+		"":       0,
+		"0":      0,
+		"0/m":    0,
+		"10":     100 * time.Millisecond,
+		"10/s":   100 * time.Millisecond,
+		"120/m":  500 * time.Millisecond,
+		"1/h":    time.Hour,
+		"0.5/s":  2 * time.Second,
+		"3600/h": time.Second,
+	} {
+		parsed, err := parseRateLimit(rate)
+		require.NoError(t, err, rate)
+		require.Equal(t, interval, parsed, rate)
+	}
+
+	for _, rate := range []string{"fast", "10/d", "-1/s", "/s", "10/"} {
+		_, err := parseRateLimit(rate)
+		require.EqualError(t, err, `Invalid rate limit "`+rate+`"`)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+
+	// Unlimited
+	for i := 0; i < 3; i++ {
+		require.True(t, l.Wait(nil))
+	}
+
+	l.SetInterval(20 * time.Millisecond)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		require.True(t, l.Wait(nil))
+	}
+	// The first run is immediate, the next ones spaced by the interval
+	require.True(t, time.Since(start) >= 40*time.Millisecond)
+
+	l.SetInterval(time.Hour)
+	require.True(t, l.Wait(nil))
+	cancel := make(chan struct{})
+	close(cancel)
+	require.False(t, l.Wait(cancel))
+}
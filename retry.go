@@ -0,0 +1,107 @@
+package nori
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jianyuan/nori/log"
+	"github.com/jianyuan/nori/message"
+	"github.com/jianyuan/nori/transport"
+)
+
+// RetryError is returned by a task handler to have the task run again
+// after Countdown.
+type RetryError struct {
+	Err       error
+	Countdown time.Duration
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("Retry in %s: %v", e.Countdown, e.Err)
+}
+
+// Retry returns an error that makes the task run again after countdown,
+// unless it was retried MaxRetries times already.
+func Retry(err error, countdown time.Duration) error {
+	return &RetryError{Err: err, Countdown: countdown}
+}
+
+// retry republishes a request to run again after the countdown of r. The
+// request was acknowledged already, it fails and is dead lettered if it
+// can't be retried.
+func (s *Server) retry(task *Task, req *message.Request, r *RetryError) {
+	if task.MaxRetries > 0 && req.Retries >= task.MaxRetries {
+		log.FromContext(s).Errorf("Task %s[%s] exceeded its %d retries", req.TaskName, req.ID, task.MaxRetries)
+		s.failRetry(req, r)
+		return
+	}
+
+	next := *req
+	next.Acknowledger = nil
+	next.Retries++
+	eta := time.Now().Add(r.Countdown).UTC()
+	next.ETA = &eta
+	next.IsUTC = true
+
+	if err := s.publishDelayed(&next, r.Countdown); err != nil {
+		log.FromContext(s).Errorln("Retry errored:", err)
+		s.failRetry(req, r)
+		return
+	}
+	s.sendEvent("task-retried", map[string]interface{}{
+		"uuid":      req.ID,
+		"exception": r.Error(),
+		"traceback": "",
+	})
+	log.FromContext(s).Infof("Task %s[%s] retry %d in %s", req.TaskName, req.ID, next.Retries, r.Countdown)
+}
+
+// failRetry gives up on a request that couldn't be retried.
+func (s *Server) failRetry(req *message.Request, r *RetryError) {
+	s.sendEvent("task-failed", map[string]interface{}{
+		"uuid":      req.ID,
+		"exception": r.Error(),
+		"traceback": "",
+	})
+	s.deadLetter(req, r)
+}
+
+// delay hands a request whose ETA is further away than the delayed delivery
+// threshold back to the broker, and reports whether it did.
+func (s *Server) delay(req *message.Request) bool {
+	if req.ETA == nil {
+		return false
+	}
+	delay := req.ETA.Sub(time.Now())
+	if !s.delayable(delay) {
+		return false
+	}
+
+	held := *req
+	held.Acknowledger = nil
+	if err := s.publishDelayed(&held, delay); err != nil {
+		log.FromContext(s).Errorln("Delayed delivery errored:", err)
+		return false
+	}
+	if err := req.Ack(); err != nil {
+		log.FromContext(s).Errorln("Ack errored:", err)
+	}
+	log.FromContext(s).Infof("Task %s[%s] delayed until %s", req.TaskName, req.ID, req.ETA)
+	return true
+}
+
+func (s *Server) delayable(delay time.Duration) bool {
+	if _, ok := s.config.Transport.(transport.Delayer); !ok {
+		return false
+	}
+	return s.config.DelayedDeliveryThreshold > 0 && delay > s.config.DelayedDeliveryThreshold
+}
+
+// publishDelayed publishes a request back to where it was received from,
+// held by the broker for delay if possible.
+func (s *Server) publishDelayed(req *message.Request, delay time.Duration) error {
+	if s.delayable(delay) {
+		return s.config.Transport.(transport.Delayer).PublishDelayed(req.Exchange, req.RoutingKey, req, delay)
+	}
+	return s.config.Transport.Publish(req.Exchange, req.RoutingKey, req)
+}
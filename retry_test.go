@@ -0,0 +1,108 @@
+package nori
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jianyuan/nori/events"
+	"github.com/jianyuan/nori/transport"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestRetry(t *testing.T) {
+	tr := &fakeTransport{}
+	s := newTestServer(t, &Configuration{
+		Transport:                tr,
+		DeadLetterExchange:       "dlx",
+		DeadLetterRoutingKey:     "failed",
+		DelayedDeliveryThreshold: time.Minute,
+	})
+	task := &Task{Name: "add", MaxRetries: 2}
+
+	req, _ := newTestRequest("a1")
+	req.Retries = 1
+	s.retry(task, req, &RetryError{Err: errors.New("busy"), Countdown: time.Second})
+	require.Len(t, tr.published, 1)
+	retried := tr.published[0]
+	require.Equal(t, "celery", retried.exchange)
+	require.Equal(t, "celery", retried.key)
+	require.Equal(t, 2, retried.req.Retries)
+	require.Nil(t, retried.req.Acknowledger)
+	require.WithinDuration(t, time.Now().Add(time.Second), *retried.req.ETA, 100*time.Millisecond)
+	require.Equal(t, 1, req.Retries)
+
+	// Past the threshold, the broker holds the request
+	s.retry(task, req, &RetryError{Err: errors.New("busy"), Countdown: time.Hour})
+	require.Len(t, tr.delayed, 1)
+	require.Equal(t, "celery", tr.delayed[0].key)
+	require.Equal(t, time.Hour, tr.delayed[0].delay)
+	require.Equal(t, 2, tr.delayed[0].req.Retries)
+
+	// Out of retries, the request is dead lettered
+	s.retry(task, retried.req, &RetryError{Err: errors.New("busy"), Countdown: time.Second})
+	require.Len(t, tr.published, 2)
+	require.Equal(t, "dlx", tr.published[1].exchange)
+	require.Equal(t, "failed", tr.published[1].key)
+	require.Len(t, tr.delayed, 1)
+}
+
+func TestRetryEvents(t *testing.T) {
+	tr := &broadcastingTransport{fakeTransport: &fakeTransport{}}
+	s := newTestServer(t, &Configuration{Transport: tr, SendEvents: true})
+	retried, err := tr.Subscribe(context.Background(), events.Exchange, "task.retried")
+	require.NoError(t, err)
+	failed, err := tr.Subscribe(context.Background(), events.Exchange, "task.failed")
+	require.NoError(t, err)
+	task := &Task{Name: "add", MaxRetries: 1}
+
+	req, _ := newTestRequest("a1")
+	s.retry(task, req, &RetryError{Err: errors.New("busy"), Countdown: time.Second})
+	require.Len(t, tr.published, 1)
+	require.Len(t, retried, 1)
+	require.Empty(t, failed)
+
+	// Out of retries, the task fails instead
+	s.retry(task, tr.published[0].req, &RetryError{Err: errors.New("busy"), Countdown: time.Second})
+	require.Len(t, tr.published, 1)
+	require.Len(t, retried, 1)
+	require.Len(t, failed, 1)
+
+	var event events.Event
+	require.NoError(t, json.Unmarshal((<-failed).Body, &event))
+	require.Equal(t, "a1", event["uuid"])
+	require.Equal(t, "Retry in 1s: busy", event["exception"])
+	require.Equal(t, "", event["traceback"])
+}
+
+func TestDelay(t *testing.T) {
+	tr := &fakeTransport{}
+	s := newTestServer(t, &Configuration{Transport: tr, DelayedDeliveryThreshold: time.Minute})
+
+	soon, soonAck := newTestRequest("soon")
+	eta := time.Now().Add(time.Second)
+	soon.ETA = &eta
+	require.False(t, s.delay(soon))
+	acked, _ := soonAck.settled()
+	require.False(t, acked)
+
+	later, laterAck := newTestRequest("later")
+	eta = time.Now().Add(time.Hour)
+	later.ETA = &eta
+	require.True(t, s.delay(later))
+	acked, _ = laterAck.settled()
+	require.True(t, acked)
+	require.Len(t, tr.delayed, 1)
+	require.Equal(t, "later", tr.delayed[0].req.ID)
+	require.InDelta(t, float64(time.Hour), float64(tr.delayed[0].delay), float64(time.Second))
+
+	// Transports that can't delay keep the request in memory
+	s = newTestServer(t, &Configuration{
+		Transport:                struct{ transport.Driver }{tr},
+		DelayedDeliveryThreshold: time.Minute,
+	})
+	require.False(t, s.delay(later))
+	require.Len(t, tr.delayed, 1)
+}
@@ -0,0 +1,46 @@
+package nori
+
+import "sync"
+
+// maxRevoked bounds the number of revoked task IDs remembered.
+const maxRevoked = 50000
+
+// revokedSet holds the IDs of revoked tasks, forgetting the oldest ones
+// past maxRevoked.
+type revokedSet struct {
+	mu    sync.Mutex
+	ids   map[string]struct{}
+	order []string
+}
+
+func newRevokedSet() *revokedSet {
+	return &revokedSet{ids: make(map[string]struct{})}
+}
+
+func (r *revokedSet) Add(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.ids[id]; ok {
+		return
+	}
+	r.ids[id] = struct{}{}
+	r.order = append(r.order, id)
+	if len(r.order) > maxRevoked {
+		delete(r.ids, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+func (r *revokedSet) Contains(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.ids[id]
+	return ok
+}
+
+func (r *revokedSet) List() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.order...)
+}
@@ -0,0 +1,27 @@
+package nori
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevokedSet(t *testing.T) {
+	r := newRevokedSet()
+	r.Add("a1")
+	r.Add("b2")
+	r.Add("a1")
+	require.True(t, r.Contains("a1"))
+	require.False(t, r.Contains("c3"))
+	require.Equal(t, []string{"a1", "b2"}, r.List())
+
+	// The oldest IDs are forgotten
+	for i := 0; i < maxRevoked; i++ {
+		r.Add(fmt.Sprint(i))
+	}
+	require.False(t, r.Contains("a1"))
+	require.False(t, r.Contains("b2"))
+	require.True(t, r.Contains("0"))
+	require.Len(t, r.List(), maxRevoked)
+}
@@ -0,0 +1,204 @@
+package nori
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/jianyuan/nori/log"
+	"github.com/jianyuan/nori/message"
+	"github.com/jianyuan/nori/transport"
+)
+
+// requestQueue holds requests waiting for a free worker.
+type requestQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  requestHeap
+	seq    uint64
+	closed bool
+}
+
+func newRequestQueue() *requestQueue {
+	q := &requestQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *requestQueue) Push(req *message.Request) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seq++
+	heap.Push(&q.items, &queuedRequest{Request: req, seq: q.seq})
+	q.cond.Signal()
+}
+
+// Pop blocks until a request is available, and returns false once the
+// queue is closed.
+func (q *requestQueue) Pop() (*message.Request, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil, false
+	}
+	return heap.Pop(&q.items).(*queuedRequest).Request, true
+}
+
+// Flush removes and returns all waiting requests.
+func (q *requestQueue) Flush() []*message.Request {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	reqs := make([]*message.Request, 0, len(q.items))
+	for len(q.items) > 0 {
+		reqs = append(reqs, heap.Pop(&q.items).(*queuedRequest).Request)
+	}
+	return reqs
+}
+
+// Requests returns the waiting requests, without removing them.
+func (q *requestQueue) Requests() []*message.Request {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	reqs := make([]*message.Request, len(q.items))
+	for i, item := range q.items {
+		reqs[i] = item.Request
+	}
+	return reqs
+}
+
+func (q *requestQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+func (q *requestQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+type queuedRequest struct {
+	*message.Request
+	seq uint64
+}
+
+// requestHeap orders requests by priority, then by arrival.
+type requestHeap []*queuedRequest
+
+func (h requestHeap) Len() int { return len(h) }
+
+func (h requestHeap) Less(i, j int) bool {
+	if h[i].Priority != h[j].Priority {
+		return h[i].Priority > h[j].Priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h requestHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *requestHeap) Push(x interface{}) { *h = append(*h, x.(*queuedRequest)) }
+
+func (h *requestHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// schedule queues a request for execution, holding it until its ETA if it
+// has one in the future. Held requests stay unacknowledged, so the
+// prefetch count is raised for as long as they are held.
+func (s *Server) schedule(req *message.Request) {
+	if req.ETA == nil || !req.ETA.After(time.Now()) {
+		s.queue.Push(req)
+		return
+	}
+
+	s.muScheduled.Lock()
+	s.scheduled[req] = time.AfterFunc(req.ETA.Sub(time.Now()), func() {
+		s.muScheduled.Lock()
+		_, ok := s.scheduled[req]
+		delete(s.scheduled, req)
+		s.muScheduled.Unlock()
+
+		if ok {
+			s.queue.Push(req)
+			s.updatePrefetch()
+		}
+	})
+	s.muScheduled.Unlock()
+
+	log.FromContext(s).Infof("Task %s[%s] scheduled for %s", req.TaskName, req.ID, req.ETA)
+	s.updatePrefetch()
+}
+
+// flushReserved forgets and returns all requests that were received but
+// haven't started. The broker redelivers them once their connection is
+// gone.
+func (s *Server) flushReserved() []*message.Request {
+	var reqs []*message.Request
+
+	s.muScheduled.Lock()
+	for req, timer := range s.scheduled {
+		timer.Stop()
+		delete(s.scheduled, req)
+		reqs = append(reqs, req)
+	}
+	s.muScheduled.Unlock()
+
+	return append(reqs, s.queue.Flush()...)
+}
+
+// maxPrefetchCount is the highest prefetch count AMQP allows, it is sent as
+// a 16-bit integer.
+const maxPrefetchCount = 65535
+
+// prefetchCount returns the number of unacknowledged requests the broker
+// may send: enough to keep every worker busy, plus those held for their ETA.
+// It is capped rather than wrapping around past maxPrefetchCount.
+func (s *Server) prefetchCount() int {
+	if s.config.PrefetchMultiplier < 0 {
+		// Unlimited
+		return 0
+	}
+
+	s.muScheduled.Lock()
+	defer s.muScheduled.Unlock()
+	count := s.config.Concurrency*s.config.PrefetchMultiplier + len(s.scheduled)
+	if count > maxPrefetchCount {
+		count = maxPrefetchCount
+	}
+	return count
+}
+
+func (s *Server) updatePrefetch() {
+	prefetcher, ok := s.config.Transport.(transport.Prefetcher)
+	if !ok {
+		return
+	}
+
+	s.muPrefetch.Lock()
+	defer s.muPrefetch.Unlock()
+
+	count := s.prefetchCount()
+	if count == s.prefetch {
+		return
+	}
+	if err := prefetcher.SetPrefetchCount(count); err != nil {
+		log.FromContext(s).Errorln("Prefetch count update errored:", err)
+		return
+	}
+	log.FromContext(s).Debugln("Prefetch count set to", count)
+	s.prefetch = count
+}
@@ -0,0 +1,112 @@
+package nori
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jianyuan/nori/message"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduleETA(t *testing.T) {
+	tr := &fakeTransport{}
+	s := newTestServer(t, &Configuration{Transport: tr})
+	require.Equal(t, 8, s.prefetchCount())
+
+	now, _ := newTestRequest("now")
+	s.schedule(now)
+	require.Equal(t, 1, s.queue.Len())
+
+	later, _ := newTestRequest("later")
+	eta := time.Now().Add(50 * time.Millisecond)
+	later.ETA = &eta
+	s.schedule(later)
+	require.Equal(t, 1, s.queue.Len())
+
+	// The held request doesn't count against the workers' share
+	require.Equal(t, 9, s.prefetchCount())
+	require.Equal(t, 9, tr.lastPrefetch())
+
+	require.Eventually(t, func() bool {
+		return s.queue.Len() == 2
+	}, time.Second, 5*time.Millisecond)
+	require.Equal(t, 8, s.prefetchCount())
+	require.Equal(t, 8, tr.lastPrefetch())
+}
+
+func TestFlushReserved(t *testing.T) {
+	s := newTestServer(t, &Configuration{})
+
+	now, _ := newTestRequest("now")
+	s.schedule(now)
+	later, _ := newTestRequest("later")
+	eta := time.Now().Add(20 * time.Millisecond)
+	later.ETA = &eta
+	s.schedule(later)
+
+	flushed := s.flushReserved()
+	require.ElementsMatch(t, flushed, []*message.Request{now, later})
+	require.Equal(t, 0, s.queue.Len())
+	require.Equal(t, 8, s.prefetchCount())
+
+	// The ETA timer was stopped
+	time.Sleep(40 * time.Millisecond)
+	require.Equal(t, 0, s.queue.Len())
+}
+
+func TestUpdatePrefetch(t *testing.T) {
+	tr := &fakeTransport{}
+	s := newTestServer(t, &Configuration{Transport: tr, Concurrency: 3, PrefetchMultiplier: 2})
+
+	s.updatePrefetch()
+	s.updatePrefetch()
+	require.Equal(t, []int{6}, tr.prefetch)
+
+	s.config.PrefetchMultiplier = -1
+	s.updatePrefetch()
+	require.Equal(t, []int{6, 0}, tr.prefetch)
+}
+
+func TestPrefetchCountCapped(t *testing.T) {
+	tr := &fakeTransport{}
+	s := newTestServer(t, &Configuration{Transport: tr, Concurrency: 4, PrefetchMultiplier: 4})
+
+	// Plenty of requests held for their ETA
+	s.muScheduled.Lock()
+	for i := 0; i < maxPrefetchCount; i++ {
+		req, _ := newTestRequest(fmt.Sprint(i))
+		s.scheduled[req] = time.NewTimer(time.Hour)
+	}
+	s.muScheduled.Unlock()
+	s.updatePrefetch()
+	require.Equal(t, maxPrefetchCount, s.prefetchCount())
+	require.Equal(t, maxPrefetchCount, tr.lastPrefetch())
+	s.flushReserved()
+
+	s.config.Concurrency = 10000
+	s.config.PrefetchMultiplier = 10
+	require.Equal(t, maxPrefetchCount, s.prefetchCount())
+}
+
+func TestRequestQueuePriority(t *testing.T) {
+	q := newRequestQueue()
+	for i, priority := range []uint8{0, 5, 0, 9, 5} {
+		req, _ := newTestRequest(fmt.Sprint(i))
+		req.Priority = priority
+		q.Push(req)
+	}
+
+	var ids []string
+	for q.Len() > 0 {
+		req, ok := q.Pop()
+		require.True(t, ok)
+		ids = append(ids, req.ID)
+	}
+	// Highest priority first, in arrival order among equals
+	require.Equal(t, []string{"3", "1", "4", "0", "2"}, ids)
+
+	q.Close()
+	_, ok := q.Pop()
+	require.False(t, ok)
+}
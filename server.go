@@ -1,14 +1,21 @@
 package nori
 
 import (
+	"errors"
+	"expvar"
 	"fmt"
 	"os"
+	"runtime"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
 
 	"gopkg.in/tomb.v2"
 
+	"github.com/jianyuan/nori/backoff"
+	"github.com/jianyuan/nori/control"
+	"github.com/jianyuan/nori/events"
 	"github.com/jianyuan/nori/log"
 	"github.com/jianyuan/nori/message"
 	"github.com/jianyuan/nori/transport"
@@ -17,14 +24,106 @@ import (
 
 type Server struct {
 	context.Context
-	Tasks  map[string]*Task
-	config *Configuration
-	tomb   *tomb.Tomb
+	Tasks   map[string]*Task
+	config  *Configuration
+	tomb    *tomb.Tomb
+	metrics metrics
+
+	queue       *requestQueue
+	muScheduled sync.Mutex
+	scheduled   map[*message.Request]*time.Timer
+	muPrefetch  sync.Mutex
+	prefetch    int
+
+	events  *events.Dispatcher
+	control *control.Node
+	started time.Time
+
+	// Whether the transport is connected, heartbeats are skipped otherwise
+	muConnected sync.Mutex
+	connected   bool
+
+	muActive sync.Mutex
+	active   map[*message.Request]*activeRequest
+	revoked  *revokedSet
+
+	workers       sync.WaitGroup
+	terminating   chan struct{}
+	terminateOnce sync.Once
+
+	// Queues consumed from, and their consumers on the current connection
+	muConsumers sync.Mutex
+	queues      []string
+	consumers   *consumerGroup
 }
 
 type Configuration struct {
 	Name      string
 	Transport transport.Driver
+
+	// Hostname identifies the worker in events, defaults to
+	// <Name>@<hostname>
+	Hostname string
+
+	// SendEvents publishes Celery events about tasks, for monitors such as
+	// Flower. The transport must implement transport.Broadcaster.
+	SendEvents bool
+
+	// Interval between worker heartbeat events, defaults to 2s
+	HeartbeatInterval time.Duration
+
+	// RemoteControl makes the worker answer the commands of `celery
+	// control` and `celery inspect`. The transport must implement
+	// transport.Broadcaster.
+	RemoteControl bool
+
+	// Queues to consume from, defaults to "celery"
+	Queues []string
+
+	// Bounds of the exponential backoff between reconnection attempts
+	ReconnectMinDelay time.Duration
+	ReconnectMaxDelay time.Duration
+
+	// Number of tasks run at the same time, defaults to the number of CPUs
+	Concurrency int
+
+	// Number of requests reserved per worker, defaults to 4. A negative
+	// value removes the limit.
+	PrefetchMultiplier int
+
+	// If DeadLetterExchange is set, requests whose handler failed are
+	// published to it with the error attached as headers:
+	// x-exception-message, and x-exception-type, the Go type of the error
+	// unless it has an ExceptionType() string method. The routing key
+	// defaults to the dead letter queue of an AMQPTransport using the same
+	// exchange.
+	DeadLetterExchange   string
+	DeadLetterRoutingKey string
+
+	// ETAs and retries further away than DelayedDeliveryThreshold are held
+	// by the broker rather than in memory, if the transport supports it.
+	// Zero disables delayed delivery.
+	DelayedDeliveryThreshold time.Duration
+
+	// Requests delivered more than MaxDeliveries times, as counted by
+	// quorum queues, are rejected without being run so that the broker
+	// dead-letters them. Zero removes the limit.
+	MaxDeliveries int
+
+	// How long a warm shutdown waits for running tasks before turning
+	// cold, defaults to 30s
+	ShutdownTimeout time.Duration
+}
+
+type metrics struct {
+	connects         expvar.Int
+	connectionErrors expvar.Int
+	connectionLosses expvar.Int
+	reconnects       expvar.Int
+
+	active    expvar.Int // requests being run
+	processed expvar.Int // requests run
+	totals    expvar.Map // requests run by task name
 }
 
 func NewServer(ctx context.Context, config *Configuration) (*Server, error) {
@@ -33,11 +132,73 @@ func NewServer(ctx context.Context, config *Configuration) (*Server, error) {
 		return nil, fmt.Errorf("Logger configuration error: %s", err)
 	}
 
+	if len(config.Queues) == 0 {
+		config.Queues = []string{"celery"}
+	}
+	if config.DeadLetterExchange != "" && config.DeadLetterRoutingKey == "" {
+		if t, ok := config.Transport.(*transport.AMQPTransport); ok && t.DeadLetterExchange == config.DeadLetterExchange {
+			config.DeadLetterRoutingKey = t.DeadLetterQueue
+		}
+		if config.DeadLetterRoutingKey == "" {
+			log.FromContext(ctx).Warnln("No dead letter routing key, failed tasks may not be routed")
+		}
+	}
+	if config.ReconnectMinDelay <= 0 {
+		config.ReconnectMinDelay = time.Second
+	}
+	if config.ReconnectMaxDelay <= 0 {
+		config.ReconnectMaxDelay = time.Minute
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = runtime.NumCPU()
+	}
+	if config.PrefetchMultiplier == 0 {
+		config.PrefetchMultiplier = 4
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = 2 * time.Second
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = 30 * time.Second
+	}
+	if config.Hostname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("Hostname lookup error: %s", err)
+		}
+		config.Hostname = config.Name + "@" + hostname
+	}
+
 	srv := &Server{
 		Context: ctx,
 		Tasks:   make(map[string]*Task),
 		config:  config,
 		tomb:    new(tomb.Tomb),
+
+		queue:     newRequestQueue(),
+		scheduled: make(map[*message.Request]*time.Timer),
+		active:    make(map[*message.Request]*activeRequest),
+		revoked:   newRevokedSet(),
+		queues:    append([]string(nil), config.Queues...),
+
+		terminating: make(chan struct{}),
+	}
+	srv.metrics.totals.Init()
+
+	if config.SendEvents {
+		b, ok := config.Transport.(transport.Broadcaster)
+		if !ok {
+			return nil, fmt.Errorf("%s can't send events", config.Transport.Name())
+		}
+		srv.events = events.NewDispatcher(b, config.Hostname)
+	}
+	if config.RemoteControl {
+		b, ok := config.Transport.(transport.Broadcaster)
+		if !ok {
+			return nil, fmt.Errorf("%s can't be controlled remotely", config.Transport.Name())
+		}
+		srv.control = control.NewNode(b, config.Hostname)
+		srv.setupControl(srv.control)
 	}
 
 	log.FromContext(srv).Info("Server set up successful")
@@ -52,13 +213,16 @@ func (s *Server) RegisterTask(t *Task) {
 	if _, existing := s.Tasks[t.Name]; existing {
 		log.FromContext(s).Panicf("Task %q already registered", t.Name)
 	}
+	if err := t.SetRateLimit(t.RateLimit); err != nil {
+		log.FromContext(s).Panicf("Task %q: %s", t.Name, err)
+	}
 	s.Tasks[t.Name] = t
 }
 
 func (s *Server) printInfo() {
-	if hostname, err := os.Hostname(); err == nil {
-		log.FromContext(s).Infoln("Hostname:", hostname)
-	}
+	log.FromContext(s).Infoln("Hostname:", s.config.Hostname)
+
+	log.FromContext(s).Infoln("Concurrency:", s.config.Concurrency)
 
 	log.FromContext(s).Infoln("Registered tasks:")
 	for _, t := range s.Tasks {
@@ -77,104 +241,402 @@ func (s *Server) Run() error {
 
 func (s *Server) run() error {
 	s.printInfo()
+	s.started = time.Now()
+
+	// Workers are left out of the tomb, so that a cold shutdown doesn't
+	// wait for their handlers to return
+	for i := 0; i < s.config.Concurrency; i++ {
+		s.workers.Add(1)
+		go s.work()
+	}
+	if s.events != nil {
+		s.tomb.Go(s.heartbeat)
+	}
+	defer s.queue.Close()
+
+	closeChan := s.config.Transport.NotifyClose(make(chan error, 1))
+	b := backoff.New(s.config.ReconnectMinDelay, s.config.ReconnectMaxDelay)
 
 	for {
 		log.FromContext(s).Infoln("Connecting")
-		select {
-		case err := <-s.setupTransport():
-			if err != nil {
-				log.FromContext(s).Errorln("Transport setup error:", err)
-				time.Sleep(5 * time.Second)
-				continue
+		err := s.setupTransport()
+		if err == nil {
+			log.FromContext(s).Infoln("Connected!")
+			s.metrics.connects.Add(1)
+			b.Reset()
+			s.setConnected(true)
+			s.workerEvent("worker-online")
+			if s.control != nil {
+				if err := s.control.Listen(s); err != nil {
+					log.FromContext(s).Errorln("Remote control setup error:", err)
+				}
 			}
 
-			log.FromContext(s).Infoln("Connected!")
+			err = s.consumeMessages(closeChan)
+			s.setConnected(false)
+			if err == nil {
+				// Server stopped
+				s.shutdown()
+				break
+			}
+			log.FromContext(s).Errorln("Connection lost:", err)
+			s.metrics.connectionLosses.Add(1)
+			s.flushReserved()
+		} else {
+			log.FromContext(s).Errorln("Transport setup error:", err)
+			s.metrics.connectionErrors.Add(1)
+		}
 
-			s.consumeMessages()
+		s.config.Transport.Close()
 
+		delay := b.Duration()
+		log.FromContext(s).Infof("Reconnecting in %s (attempt %d)", delay, b.Attempt())
+		select {
+		case <-time.After(delay):
+			s.metrics.reconnects.Add(1)
 		case <-s.tomb.Dying():
 			log.FromContext(s).Infoln("Cancelled")
-			break
-
-		case <-time.After(5 * time.Second):
-			// TODO better retry mechanism
-			log.FromContext(s).Errorln("Timed out")
-			time.Sleep(5 * time.Second)
-			continue
+			return nil
 		}
 	}
 
 	return s.config.Transport.Close()
 }
 
-func (s *Server) setupTransport() <-chan error {
-	errChan := make(chan error)
-	s.tomb.Go(func() error {
-		if err := s.config.Transport.Init(s.Context); err != nil {
-			errChan <- err
-			return nil
-		}
-		errChan <- s.config.Transport.Setup()
-		return nil
-	})
-	return errChan
+func (s *Server) setConnected(connected bool) {
+	s.muConnected.Lock()
+	defer s.muConnected.Unlock()
+	s.connected = connected
 }
 
-func (s *Server) consumeMessages() {
-	reqChan, err := s.config.Transport.Consume("celery")
+func (s *Server) isConnected() bool {
+	s.muConnected.Lock()
+	defer s.muConnected.Unlock()
+	return s.connected
+}
+
+func (s *Server) setupTransport() error {
+	if err := s.config.Transport.Init(s.Context); err != nil {
+		return err
+	}
+	return s.config.Transport.Setup()
+}
+
+// consumeMessages handles requests from all configured queues until the
+// server is stopped, in which case it returns nil, or the connection to the
+// broker is lost.
+func (s *Server) consumeMessages(closeChan <-chan error) error {
+	// Drop a close notification left over from a previous connection
+	select {
+	case <-closeChan:
+	default:
+	}
+
+	// The prefetch count is reset along with the channel
+	s.muPrefetch.Lock()
+	s.prefetch = -1
+	s.muPrefetch.Unlock()
+	s.updatePrefetch()
+
+	consumers, err := s.consumeQueues()
 	if err != nil {
-		log.FromContext(s).Errorln("Transport consume error:", err)
-		return
+		return err
 	}
+	defer s.stopConsumers(consumers)
 
 	for {
 		select {
-		case req := <-reqChan:
-			pretty.Println("Request:", req)
-
-			if task, ok := s.Tasks[req.TaskName]; ok {
-				resp, err := callTaskHandlerSafely(task.Handler, req)
-				if err != nil {
-					log.FromContext(s).Errorln("Task handler errored:", err)
-				} else {
-					pretty.Println("Response:", resp)
-					log.FromContext(s).Infoln("Replying...")
-
-					if err := s.config.Transport.Reply(req, resp); err != nil {
-						log.FromContext(s).Errorln("Reply errored:", err)
-					}
-				}
-			} else {
-				log.FromContext(s).Errorln("Unknown task:", req.TaskName)
-			}
+		case req := <-consumers.reqChan:
+			s.receive(req)
+
+		case <-consumers.lost:
+			return errors.New("consumer channel closed")
+
+		case err := <-closeChan:
+			return err
 
 		case <-s.tomb.Dying():
+			return nil
+		}
+	}
+}
+
+func (s *Server) receive(req *message.Request) {
+	pretty.Println("Request:", req)
+
+	if s.config.MaxDeliveries > 0 && req.DeliveryCount() >= int64(s.config.MaxDeliveries) {
+		log.FromContext(s).Errorf("Task %s[%s] delivered %d times, rejecting it", req.TaskName, req.ID, req.DeliveryCount()+1)
+		if err := req.Reject(false); err != nil {
+			log.FromContext(s).Errorln("Reject errored:", err)
+		}
+		return
+	}
+
+	if _, ok := s.Tasks[req.TaskName]; !ok {
+		log.FromContext(s).Errorln("Unknown task:", req.TaskName)
+		if err := req.Reject(false); err != nil {
+			log.FromContext(s).Errorln("Reject errored:", err)
+		}
+		return
+	}
+
+	if s.revoked.Contains(req.ID) {
+		s.discardRevoked(req)
+		return
+	}
+
+	s.sendEvent("task-received", map[string]interface{}{
+		"uuid":    req.ID,
+		"name":    req.TaskName,
+		"args":    events.Repr(req.Args),
+		"kwargs":  events.Repr(req.KWArgs),
+		"retries": req.Retries,
+		"eta":     formatTime(req.ETA),
+		"expires": formatTime(req.ExpiresAt),
+	})
+
+	if s.delay(req) {
+		return
+	}
+	s.schedule(req)
+}
+
+// work runs queued requests until the queue is closed.
+func (s *Server) work() {
+	defer s.workers.Done()
+
+	for {
+		req, ok := s.queue.Pop()
+		if !ok {
 			return
 		}
+		s.execute(req)
 	}
 }
 
-func (s *Server) Wait() error {
-	return s.tomb.Wait()
+func (s *Server) execute(req *message.Request) {
+	task := s.Tasks[req.TaskName]
+
+	if !task.limiter.Wait(s.tomb.Dying()) {
+		if err := req.Reject(true); err != nil {
+			log.FromContext(s).Errorln("Reject errored:", err)
+		}
+		return
+	}
+	if s.revoked.Contains(req.ID) {
+		s.discardRevoked(req)
+		return
+	}
+
+	// Acknowledge before running the task, like Celery does by default
+	if err := req.Ack(); err != nil {
+		log.FromContext(s).Errorln("Ack errored:", err)
+	}
+
+	if req.ExpiresAt != nil && time.Now().After(*req.ExpiresAt) {
+		log.FromContext(s).Warnf("Task %s[%s] expired at %s", req.TaskName, req.ID, req.ExpiresAt)
+		s.sendEvent("task-revoked", map[string]interface{}{
+			"uuid":       req.ID,
+			"terminated": false,
+			"signum":     nil,
+			"expired":    true,
+		})
+		return
+	}
+
+	s.sendEvent("task-started", map[string]interface{}{
+		"uuid": req.ID,
+	})
+	start := time.Now()
+	s.startActive(req, start)
+	defer s.stopActive(req)
+
+	resp, err := s.callTask(task, req)
+	if r, ok := err.(*RetryError); ok {
+		s.retry(task, req, r)
+		return
+	}
+	if err != nil {
+		log.FromContext(s).Errorln("Task handler errored:", err)
+		s.sendEvent("task-failed", map[string]interface{}{
+			"uuid":      req.ID,
+			"exception": err.Error(),
+			"traceback": "",
+		})
+		s.deadLetter(req, err)
+		return
+	}
+
+	succeeded := map[string]interface{}{
+		"uuid":    req.ID,
+		"runtime": time.Since(start).Seconds(),
+		"result":  events.Repr(nil),
+	}
+	if resp != nil {
+		succeeded["result"] = events.Repr(resp.GetBody())
+	}
+	s.sendEvent("task-succeeded", succeeded)
+	if resp == nil {
+		return
+	}
+
+	pretty.Println("Response:", resp)
+	log.FromContext(s).Infoln("Replying...")
+
+	if err := s.config.Transport.Reply(req, resp); err != nil {
+		log.FromContext(s).Errorln("Reply errored:", err)
+	}
+}
+
+// deadLetter publishes a failed request to the dead letter exchange, if one
+// is configured. The request was acknowledged already, so this is the only
+// copy left of it.
+func (s *Server) deadLetter(req *message.Request, cause error) {
+	if s.config.DeadLetterExchange == "" {
+		return
+	}
+
+	dead := *req
+	dead.Headers = make(map[string]interface{}, len(req.Headers)+2)
+	for k, v := range req.Headers {
+		dead.Headers[k] = v
+	}
+	dead.Headers["x-exception-type"] = exceptionType(cause)
+	dead.Headers["x-exception-message"] = cause.Error()
+
+	err := s.config.Transport.Publish(s.config.DeadLetterExchange, s.config.DeadLetterRoutingKey, &dead)
+	if err != nil {
+		log.FromContext(s).Errorln("Dead lettering errored:", err)
+		return
+	}
+	log.FromContext(s).Infof("Task %s[%s] dead lettered to %q", req.TaskName, req.ID, s.config.DeadLetterExchange)
 }
 
-func (s *Server) Stop() {
-	s.tomb.Kill(nil)
+// exceptionType names the type of an error, as given by its ExceptionType
+// method if it has one.
+func exceptionType(err error) string {
+	if typed, ok := err.(interface {
+		ExceptionType() string
+	}); ok {
+		return typed.ExceptionType()
+	}
+	return fmt.Sprintf("%T", err)
 }
 
-func callTaskHandlerSafely(t TaskHandlerFunc, req *message.Request) (message.Response, error) {
-	var resp message.Response
-	var err error
-	resp, err = func() (message.Response, error) {
-		defer func() {
-			if r := recover(); r != nil {
-				err = fmt.Errorf("Handler panicked: %v", r)
-			}
-		}()
-		return t(req)
+// activeRequest is a request being run.
+type activeRequest struct {
+	start  time.Time
+	cancel context.CancelFunc
+}
+
+// startActive tracks a request being run, and gives it a context that a
+// cold shutdown cancels.
+func (s *Server) startActive(req *message.Request, start time.Time) {
+	parent := req.Ctx
+	if parent == nil {
+		parent = s
+	}
+	ctx, cancel := context.WithCancel(parent)
+	req.Ctx = ctx
+
+	s.muActive.Lock()
+	s.active[req] = &activeRequest{start: start, cancel: cancel}
+	s.muActive.Unlock()
+
+	s.metrics.active.Add(1)
+}
+
+func (s *Server) stopActive(req *message.Request) {
+	s.muActive.Lock()
+	if a, ok := s.active[req]; ok {
+		a.cancel()
+		delete(s.active, req)
+	}
+	s.muActive.Unlock()
+
+	s.metrics.active.Add(-1)
+	s.metrics.processed.Add(1)
+	s.metrics.totals.Add(req.TaskName, 1)
+}
+
+// discardRevoked acknowledges a revoked request without running it.
+func (s *Server) discardRevoked(req *message.Request) {
+	log.FromContext(s).Infof("Task %s[%s] revoked, discarding it", req.TaskName, req.ID)
+	if err := req.Ack(); err != nil {
+		log.FromContext(s).Errorln("Ack errored:", err)
+	}
+	s.sendEvent("task-revoked", map[string]interface{}{
+		"uuid":       req.ID,
+		"terminated": false,
+		"signum":     nil,
+		"expired":    false,
+	})
+}
+
+// TimeLimitError is returned for tasks that ran past their hard time limit.
+type TimeLimitError struct {
+	Limit time.Duration
+}
+
+func (e *TimeLimitError) Error() string {
+	return fmt.Sprintf("Time limit (%s) exceeded", e.Limit)
+}
+
+// callTask runs the handler of a task within its time limits. A handler
+// that overruns its hard limit keeps running, as goroutines can't be
+// killed, but its result is ignored.
+func (s *Server) callTask(task *Task, req *message.Request) (message.Response, error) {
+	soft, hard := task.timeLimits()
+	if soft > 0 {
+		ctx, cancel := context.WithTimeout(req.Ctx, soft)
+		defer cancel()
+		req.Ctx = ctx
+	}
+	if hard <= 0 {
+		return callTaskHandlerSafely(task.Handler, req)
+	}
+
+	type result struct {
+		resp message.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := callTaskHandlerSafely(task.Handler, req)
+		done <- result{resp, err}
 	}()
-	if err != nil {
-		return nil, err
+
+	select {
+	case r := <-done:
+		return r.resp, r.err
+	case <-time.After(hard):
+		return nil, &TimeLimitError{Limit: hard}
+	}
+}
+
+func (s *Server) sendEvent(eventType string, fields map[string]interface{}) {
+	if err := s.events.Send(eventType, fields); err != nil {
+		log.FromContext(s).Warnf("Sending %s event errored: %s", eventType, err)
+	}
+}
+
+// formatTime formats an optional time the way Celery does in events.
+func formatTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
 	}
-	return resp, nil
+	return t.Format(time.RFC3339Nano)
+}
+
+func (s *Server) Wait() error {
+	return s.tomb.Wait()
+}
+
+func callTaskHandlerSafely(t TaskHandlerFunc, req *message.Request) (resp message.Response, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			resp, err = nil, fmt.Errorf("Handler panicked: %v", r)
+		}
+	}()
+	return t(req)
 }
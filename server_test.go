@@ -0,0 +1,177 @@
+package nori
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jianyuan/nori/events"
+	"github.com/jianyuan/nori/message"
+	"github.com/jianyuan/nori/transport"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type published struct {
+	exchange string
+	key      string
+	req      *message.Request
+	delay    time.Duration
+}
+
+// fakeTransport records what the server publishes and settles.
+type fakeTransport struct {
+	transport.Driver
+
+	mu        sync.Mutex
+	published []published
+	delayed   []published
+	prefetch  []int
+	cancelled []string
+}
+
+func (*fakeTransport) Name() string { return "FakeTransport" }
+
+func (t *fakeTransport) Publish(exchange, key string, req *message.Request) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.published = append(t.published, published{exchange, key, req, 0})
+	return nil
+}
+
+func (t *fakeTransport) PublishDelayed(exchange, key string, req *message.Request, delay time.Duration) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.delayed = append(t.delayed, published{exchange, key, req, delay})
+	return nil
+}
+
+func (t *fakeTransport) SetPrefetchCount(count int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prefetch = append(t.prefetch, count)
+	return nil
+}
+
+func (t *fakeTransport) Cancel(queue string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cancelled = append(t.cancelled, queue)
+	return nil
+}
+
+func (t *fakeTransport) Reply(*message.Request, message.Response) error { return nil }
+
+func (t *fakeTransport) lastPrefetch() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.prefetch) == 0 {
+		return -1
+	}
+	return t.prefetch[len(t.prefetch)-1]
+}
+
+// fakeAcknowledger records how a request was settled.
+type fakeAcknowledger struct {
+	mu       sync.Mutex
+	acked    bool
+	rejected []bool // requeue flags
+}
+
+func (a *fakeAcknowledger) Ack() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acked = true
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(requeue bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rejected = append(a.rejected, requeue)
+	return nil
+}
+
+func (a *fakeAcknowledger) settled() (bool, []bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.acked, append([]bool(nil), a.rejected...)
+}
+
+func newTestServer(t *testing.T, config *Configuration) *Server {
+	config.Name = "tasks"
+	config.Hostname = "tasks@test"
+	if config.Transport == nil {
+		config.Transport = &fakeTransport{}
+	}
+	if config.Concurrency == 0 {
+		config.Concurrency = 2
+	}
+
+	s, err := NewServer(context.Background(), config)
+	require.NoError(t, err)
+	return s
+}
+
+func newTestRequest(id string) (*message.Request, *fakeAcknowledger) {
+	ack := &fakeAcknowledger{}
+	req := message.NewRequest()
+	req.TaskName = "tasks.add"
+	req.ID = id
+	req.Exchange = "celery"
+	req.RoutingKey = "celery"
+	req.Acknowledger = ack
+	return req, ack
+}
+
+type valueError struct{}
+
+func (valueError) Error() string { return "bad value" }
+
+func (valueError) ExceptionType() string { return "ValueError" }
+
+func TestDeadLetter(t *testing.T) {
+	driver, err := transport.NewAMQPTransport("amqp://localhost")
+	require.NoError(t, err)
+	amqpTransport := driver.(*transport.AMQPTransport)
+	amqpTransport.DeadLetterExchange = "dlx"
+	amqpTransport.DeadLetterQueue = "failed"
+	s := newTestServer(t, &Configuration{Transport: amqpTransport, DeadLetterExchange: "dlx"})
+	require.Equal(t, "failed", s.config.DeadLetterRoutingKey)
+
+	tr := &fakeTransport{}
+	s = newTestServer(t, &Configuration{Transport: tr, DeadLetterExchange: "dlx", DeadLetterRoutingKey: "failed"})
+	req, _ := newTestRequest("a1")
+	s.deadLetter(req, valueError{})
+	s.deadLetter(req, errors.New("boom"))
+
+	require.Len(t, tr.published, 2)
+	require.Equal(t, "dlx", tr.published[0].exchange)
+	require.Equal(t, "failed", tr.published[0].key)
+	require.Equal(t, "ValueError", tr.published[0].req.Headers["x-exception-type"])
+	require.Equal(t, "bad value", tr.published[0].req.Headers["x-exception-message"])
+	require.Equal(t, "*errors.errorString", tr.published[1].req.Headers["x-exception-type"])
+}
+
+func TestHeartbeatWhileConnected(t *testing.T) {
+	tr := &broadcastingTransport{fakeTransport: &fakeTransport{}}
+	s := newTestServer(t, &Configuration{Transport: tr, SendEvents: true, HeartbeatInterval: 10 * time.Millisecond})
+	heartbeats, err := tr.Subscribe(context.Background(), events.Exchange, "worker.heartbeat")
+	require.NoError(t, err)
+	s.tomb.Go(s.heartbeat)
+
+	// Disconnected workers stay silent
+	time.Sleep(50 * time.Millisecond)
+	require.Empty(t, heartbeats)
+
+	s.setConnected(true)
+	select {
+	case <-heartbeats:
+	case <-time.After(time.Second):
+		t.Fatal("No heartbeat once connected")
+	}
+
+	s.tomb.Kill(nil)
+	require.NoError(t, s.tomb.Wait())
+}
@@ -0,0 +1,121 @@
+package nori
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jianyuan/nori/log"
+	"github.com/jianyuan/nori/message"
+	"github.com/jianyuan/nori/transport"
+)
+
+// Stop shuts the server down warmly: it stops consuming, requeues the
+// requests that haven't started and waits up to ShutdownTimeout for the
+// running ones to finish before closing the transport.
+func (s *Server) Stop() {
+	s.tomb.Kill(nil)
+}
+
+// Terminate shuts the server down coldly: the contexts of the running
+// tasks are cancelled and their requests requeued without waiting for them.
+// It also cuts a warm shutdown short.
+func (s *Server) Terminate() {
+	s.terminateOnce.Do(func() {
+		close(s.terminating)
+	})
+	s.tomb.Kill(nil)
+}
+
+// HandleSignals makes SIGINT and SIGTERM stop the server warmly, and a
+// second one or SIGQUIT terminate it.
+func (s *Server) HandleSignals() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	go func() {
+		defer signal.Stop(sigs)
+
+		stopping := false
+		for {
+			select {
+			case sig := <-sigs:
+				if stopping || sig == syscall.SIGQUIT {
+					log.FromContext(s).Warnf("Cold shutdown (%s)", sig)
+					s.Terminate()
+					return
+				}
+				log.FromContext(s).Warnf("Warm shutdown (%s), signal again to terminate", sig)
+				stopping = true
+				s.Stop()
+
+			case <-s.tomb.Dead():
+				return
+			}
+		}
+	}()
+}
+
+// shutdown winds the server down once stopped, while still connected so
+// that running tasks can be acknowledged and replied to.
+func (s *Server) shutdown() {
+	log.FromContext(s).Infoln("Shutting down")
+
+	if canceller, ok := s.config.Transport.(transport.Canceller); ok {
+		for _, queue := range s.Queues() {
+			if err := canceller.Cancel(queue); err != nil {
+				log.FromContext(s).Warnln("Consumer cancel errored:", err)
+			}
+		}
+	}
+	for _, req := range s.flushReserved() {
+		if err := req.Reject(true); err != nil {
+			log.FromContext(s).Errorln("Reject errored:", err)
+		}
+	}
+	s.queue.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(s.config.ShutdownTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		log.FromContext(s).Infoln("Running tasks finished")
+	case <-timer.C:
+		log.FromContext(s).Warnf("Tasks still running after %s", s.config.ShutdownTimeout)
+		s.requeueActive()
+	case <-s.terminating:
+		s.requeueActive()
+	}
+
+	s.workerEvent("worker-offline")
+}
+
+// requeueActive cancels the contexts of the running tasks and publishes
+// their requests again, as they were acknowledged already. A handler that
+// ignores its context may still complete, running its task twice.
+func (s *Server) requeueActive() {
+	// Published without the lock, tasks finishing meanwhile must not wait
+	// on the broker to remove themselves
+	s.muActive.Lock()
+	reqs := make([]*message.Request, 0, len(s.active))
+	for req, a := range s.active {
+		a.cancel()
+		reqs = append(reqs, req)
+	}
+	s.muActive.Unlock()
+
+	for _, req := range reqs {
+		if err := s.config.Transport.Publish(req.Exchange, req.RoutingKey, req); err != nil {
+			log.FromContext(s).Errorf("Task %s[%s] requeue errored: %s", req.TaskName, req.ID, err)
+			continue
+		}
+		log.FromContext(s).Warnf("Task %s[%s] requeued", req.TaskName, req.ID)
+	}
+}
@@ -0,0 +1,181 @@
+package nori
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jianyuan/nori/message"
+	"github.com/stretchr/testify/require"
+)
+
+// startShutdownTest runs a single worker busy with a blocking task and
+// holding another request in reserve, and returns them.
+func startShutdownTest(t *testing.T, config *Configuration, handler TaskHandlerFunc) (s *Server, running, reserved *fakeAcknowledger) {
+	config.Concurrency = 1
+	config.Queues = []string{"celery"}
+	s = newTestServer(t, config)
+	s.RegisterTask(&Task{Name: "add", Handler: handler})
+	s.workers.Add(1)
+	go s.work()
+
+	req, running := newTestRequest("a1")
+	s.schedule(req)
+	require.Eventually(t, func() bool { return len(s.activeRequests()) == 1 }, time.Second, 5*time.Millisecond)
+
+	req, reserved = newTestRequest("b2")
+	s.schedule(req)
+	return s, running, reserved
+}
+
+// shutdownAsync shuts the server down and returns a channel closed once
+// done.
+func shutdownAsync(s *Server) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		s.shutdown()
+		close(done)
+	}()
+	return done
+}
+
+func (t *fakeTransport) publishedIDs() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ids := make([]string, len(t.published))
+	for i, p := range t.published {
+		ids[i] = p.req.ID
+	}
+	return ids
+}
+
+func TestShutdownWarm(t *testing.T) {
+	tr := &fakeTransport{}
+	release := make(chan struct{})
+	s, running, reserved := startShutdownTest(t, &Configuration{Transport: tr}, func(*message.Request) (message.Response, error) {
+		<-release
+		return nil, nil
+	})
+
+	done := shutdownAsync(s)
+
+	// Consumers are cancelled and the reserved request requeued
+	require.Eventually(t, func() bool {
+		_, rejected := reserved.settled()
+		return len(rejected) == 1
+	}, time.Second, 5*time.Millisecond)
+	acked, rejected := reserved.settled()
+	require.False(t, acked)
+	require.Equal(t, []bool{true}, rejected)
+	require.Equal(t, []string{"celery"}, tr.cancelled)
+
+	// The running task is waited for
+	select {
+	case <-done:
+		t.Fatal("Shutdown didn't wait for the running task")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown didn't return")
+	}
+
+	acked, rejected = running.settled()
+	require.True(t, acked)
+	require.Empty(t, rejected)
+	require.Empty(t, tr.publishedIDs())
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	tr := &fakeTransport{}
+	cancelled := make(chan struct{})
+	s, _, _ := startShutdownTest(t, &Configuration{Transport: tr, ShutdownTimeout: 50 * time.Millisecond}, func(req *message.Request) (message.Response, error) {
+		<-req.Ctx.Done()
+		close(cancelled)
+		return nil, req.Ctx.Err()
+	})
+
+	start := time.Now()
+	select {
+	case <-shutdownAsync(s):
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown didn't time out")
+	}
+	require.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	// The running task is cancelled and its request published again
+	<-cancelled
+	require.Equal(t, []string{"a1"}, tr.publishedIDs())
+	s.workers.Wait()
+}
+
+func TestShutdownTerminate(t *testing.T) {
+	tr := &fakeTransport{}
+	release := make(chan struct{})
+	s, _, reserved := startShutdownTest(t, &Configuration{Transport: tr}, func(*message.Request) (message.Response, error) {
+		// Ignores its context
+		<-release
+		return nil, nil
+	})
+
+	done := shutdownAsync(s)
+	require.Eventually(t, func() bool {
+		_, rejected := reserved.settled()
+		return len(rejected) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// Cuts the warm shutdown short, without waiting for the task
+	s.Terminate()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Terminate didn't cut the shutdown short")
+	}
+	require.Equal(t, []string{"a1"}, tr.publishedIDs())
+
+	// Terminating again is harmless
+	s.Terminate()
+
+	close(release)
+	s.workers.Wait()
+}
+
+// blockingTransport blocks publishing until released.
+type blockingTransport struct {
+	*fakeTransport
+	release chan struct{}
+}
+
+func (t *blockingTransport) Publish(exchange, key string, req *message.Request) error {
+	<-t.release
+	return t.fakeTransport.Publish(exchange, key, req)
+}
+
+func TestShutdownRequeueUnlocked(t *testing.T) {
+	tr := &blockingTransport{fakeTransport: &fakeTransport{}, release: make(chan struct{})}
+	s, running, _ := startShutdownTest(t, &Configuration{Transport: tr}, func(req *message.Request) (message.Response, error) {
+		<-req.Ctx.Done()
+		return nil, nil
+	})
+
+	s.flushReserved()
+	requeued := make(chan struct{})
+	go func() {
+		s.requeueActive()
+		close(requeued)
+	}()
+
+	// The cancelled task finishes while the broker is slow to take its
+	// request
+	require.Eventually(t, func() bool { return len(s.activeRequests()) == 0 }, time.Second, 5*time.Millisecond)
+	acked, _ := running.settled()
+	require.True(t, acked)
+
+	close(tr.release)
+	<-requeued
+	require.Equal(t, []string{"a1"}, tr.publishedIDs())
+
+	s.queue.Close()
+	s.workers.Wait()
+}
@@ -1,6 +1,11 @@
 package nori
 
-import "github.com/jianyuan/nori/message"
+import (
+	"sync"
+	"time"
+
+	"github.com/jianyuan/nori/message"
+)
 
 type TaskHandlerFunc func(*message.Request) (message.Response, error)
 
@@ -9,4 +14,47 @@ type Task struct {
 	Handler  TaskHandlerFunc
 	Request  interface{}
 	Response interface{}
+
+	// MaxRetries caps the number of times the task is retried, zero
+	// removes the limit
+	MaxRetries int
+
+	// RateLimit caps how often the task is run, e.g. "10/s" or "100/m"
+	RateLimit string
+
+	// The context of the request is cancelled after SoftTimeLimit, the
+	// task fails if it doesn't return within TimeLimit
+	SoftTimeLimit time.Duration
+	TimeLimit     time.Duration
+
+	mu      sync.Mutex
+	limiter rateLimiter
+}
+
+// SetRateLimit changes the rate limit of the task.
+func (t *Task) SetRateLimit(rate string) error {
+	interval, err := parseRateLimit(rate)
+	if err != nil {
+		return err
+	}
+	t.limiter.SetInterval(interval)
+
+	t.mu.Lock()
+	t.RateLimit = rate
+	t.mu.Unlock()
+	return nil
+}
+
+// SetTimeLimits changes the time limits of the task.
+func (t *Task) SetTimeLimits(soft, hard time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.SoftTimeLimit = soft
+	t.TimeLimit = hard
+}
+
+func (t *Task) timeLimits() (soft, hard time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.SoftTimeLimit, t.TimeLimit
 }
@@ -3,30 +3,84 @@ package transport
 import (
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"strconv"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
 
+	noriamqp "github.com/jianyuan/nori/amqp"
 	"github.com/jianyuan/nori/log"
 	"github.com/jianyuan/nori/message"
 	"github.com/jianyuan/nori/protocol"
-	"github.com/kr/pretty"
 	"github.com/streadway/amqp"
 	"gopkg.in/tomb.v2"
 )
 
+var amqpMetrics = expvar.NewMap("nori.amqp")
+
+var (
+	_ Prefetcher     = (*AMQPTransport)(nil)
+	_ Delayer        = (*AMQPTransport)(nil)
+	_ QueueInspector = (*AMQPTransport)(nil)
+	_ Broadcaster    = (*AMQPTransport)(nil)
+	_ Canceller      = (*AMQPTransport)(nil)
+)
+
 type AMQPTransport struct {
 	context.Context
-	URL          string
+	Factory      noriamqp.ConnectionFactory
 	ExchangeName string
 	ExchangeKind string
 	tomb         *tomb.Tomb
-	conn         *amqp.Connection
-	channel      *amqp.Channel
+	conn         noriamqp.Connection
+	channel      noriamqp.Channel
+
+	// Topology is declared on every (re)connect. The exchange and the
+	// queues consumed from are added to it.
+	Topology *noriamqp.Topology
+
+	// DeadLetterExchange, if set, receives the messages rejected from the
+	// queues consumed from. It is declared along with DeadLetterQueue,
+	// which is bound to it by its name.
+	DeadLetterExchange string
+	DeadLetterQueue    string
+
+	// MaxPriority, if set, enables priorities up to it on the queues
+	// consumed from.
+	MaxPriority uint8
+
+	// QueueType of the queues consumed from, classic by default. Quorum
+	// queues drop messages delivered more than DeliveryLimit times, if set.
+	// As they don't support global QoS, the prefetch count applies to each
+	// consumer, and only to those started after it is set.
+	QueueType     string
+	DeliveryLimit int
+
+	// MaxChannels caps the channels opened for publishing. PublishTimeout
+	// caps how long publishing waits for one while all of them are in use,
+	// zero waits until the connection is closed.
+	MaxChannels    int
+	PublishTimeout time.Duration
+	pool           *noriamqp.ChannelPool
+
+	// PublisherConfirms makes publishing wait up to ConfirmTimeout for the
+	// broker to confirm each message.
+	PublisherConfirms bool
+	ConfirmTimeout    time.Duration
+
+	muNotify sync.Mutex
+	closeChs []chan<- error
+
+	// Consumer tags by queue name
+	muConsumers sync.Mutex
+	consumers   map[string]string
+	consumerSeq int
 }
 
-func (AMQPTransport) Name() string { return "AMQPTransport" }
+func (*AMQPTransport) Name() string { return "AMQPTransport" }
 
 func (t *AMQPTransport) Init(ctx context.Context) error {
 	t.Context = ctx
@@ -34,131 +88,361 @@ func (t *AMQPTransport) Init(ctx context.Context) error {
 }
 
 func (t *AMQPTransport) Setup() error {
-	// TODO advanced config
-	conn, err := amqp.Dial(t.URL)
+	// Consumers of a previous connection are done once it is gone
+	t.tomb.Kill(nil)
+	t.tomb = new(tomb.Tomb)
+
+	t.muConsumers.Lock()
+	t.consumers = make(map[string]string)
+	t.muConsumers.Unlock()
+
+	conn, err := t.Factory.Create()
 	if err != nil {
 		return err
 	}
 	t.conn = conn
 
-	ch, err := conn.Channel()
+	ch, err := conn.CreateChannel()
 	if err != nil {
 		return err
 	}
 	t.channel = ch
 
-	if err := t.channel.ExchangeDeclare(
-		t.ExchangeName, // name
-		t.ExchangeKind, // kind
-		true,           // durable
-		false,          // autoDelete
-		false,          // internal
-		false,          // noWait
-		nil,            // args
-	); err != nil {
+	pool, err := noriamqp.NewChannelPool(conn, t.MaxChannels)
+	if err != nil {
+		return err
+	}
+	pool.Timeout = t.PublishTimeout
+	if t.PublisherConfirms {
+		pool.Wrap = func(ch noriamqp.Channel) (noriamqp.Channel, error) {
+			return noriamqp.NewConfirmedChannel(ch, t.ConfirmTimeout)
+		}
+	}
+	if t.pool != nil {
+		// Publishers waiting on the channels of the previous connection
+		// give up
+		t.pool.Close()
+	}
+	t.pool = pool
+
+	// The channel is also closed when the connection is lost
+	closeChan := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		// Closed without an error on a graceful Close
+		if err, ok := <-closeChan; ok {
+			log.FromContext(t).Warnln("Channel closed:", err)
+			t.onClose(err)
+		}
+	}()
+
+	exchange, err := t.exchange()
+	if err != nil {
+		return err
+	}
+	if err := t.Topology.AddExchange(exchange); err != nil {
 		return err
 	}
+	if t.DeadLetterExchange != "" {
+		if err := t.addDeadLetterQueue(); err != nil {
+			return err
+		}
+	}
+	return t.declare(t.Topology)
+}
 
-	return nil
+func (t *AMQPTransport) addDeadLetterQueue() error {
+	if t.DeadLetterQueue == "" {
+		return errors.New("AMQPTransport: no dead letter queue specified")
+	}
+
+	exchange, err := noriamqp.NewExchange(
+		"direct",             // kind string
+		t.DeadLetterExchange, // name string
+		true,                 // durable bool
+		false,                // autoDelete bool
+		nil,                  // args map[string]interface{}
+	)
+	if err != nil {
+		return err
+	}
+	q, err := noriamqp.NewQueue(
+		t.DeadLetterQueue, // name string
+		true,              // durable bool
+		false,             // exclusive bool
+		false,             // autoDelete bool
+		nil,               // args map[string]interface{}
+	)
+	if err != nil {
+		return err
+	}
+	b, err := noriamqp.NewBinding(
+		q,                 // dest Bindable
+		exchange,          // exchange *Exchange
+		t.DeadLetterQueue, // routingKey string
+		nil,               // args map[string]interface{}
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := t.Topology.AddExchange(exchange); err != nil {
+		return err
+	}
+	if err := t.Topology.AddQueue(q); err != nil {
+		return err
+	}
+	return t.Topology.AddBinding(b)
+}
+
+func (t *AMQPTransport) exchange() (*noriamqp.Exchange, error) {
+	return noriamqp.NewExchange(
+		t.ExchangeKind, // kind string
+		t.ExchangeName, // name string
+		true,           // durable bool
+		false,          // autoDelete bool
+		nil,            // args map[string]interface{}
+	)
+}
+
+func (t *AMQPTransport) declare(topology *noriamqp.Topology) error {
+	admin, err := noriamqp.NewAMQPAdmin(t.conn)
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+
+	return topology.Declare(admin)
+}
+
+func (t *AMQPTransport) InspectQueue(name string) (*QueueStats, error) {
+	if t.conn == nil {
+		return nil, errors.New("AMQPTransport: not set up")
+	}
+	admin, err := noriamqp.NewAMQPAdmin(t.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer admin.Close()
+
+	stats, err := admin.InspectQueue(name)
+	if err == noriamqp.ErrQueueNotFound {
+		return nil, ErrQueueNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &QueueStats{
+		Name:      stats.Name,
+		Messages:  stats.Messages,
+		Consumers: stats.Consumers,
+	}, nil
+}
+
+func (t *AMQPTransport) PurgeQueue(name string) (int, error) {
+	if t.conn == nil {
+		return 0, errors.New("AMQPTransport: not set up")
+	}
+	admin, err := noriamqp.NewAMQPAdmin(t.conn)
+	if err != nil {
+		return 0, err
+	}
+	defer admin.Close()
+
+	n, err := admin.PurgeQueue(name, false)
+	if err == noriamqp.ErrQueueNotFound {
+		return 0, ErrQueueNotFound
+	}
+	return n, err
 }
 
 func (t *AMQPTransport) Consume(name string) (<-chan *message.Request, error) {
-	deliveryChan, err := t.consume(name)
+	deliveryChan, tag, err := t.consume(name)
 	if err != nil {
 		return nil, err
 	}
 
 	msgChan := make(chan *message.Request)
-	t.tomb.Go(func() error {
+	// Setup replaces the tomb on every reconnect
+	tomb := t.tomb
+	tomb.Go(func() error {
+		defer close(msgChan)
 		for {
 			select {
-			case <-t.tomb.Dying():
+			case <-tomb.Dying():
 				return nil
 
 			case delivery, ok := <-deliveryChan:
 				if !ok {
-					log.FromContext(t).Warnln("Channel closed")
+					if t.consumerTag(name) == tag {
+						log.FromContext(t).Warnln("Channel closed")
+					}
 					return nil
 				}
 
 				msg, err := t.parseDelivery(delivery)
 				if err != nil {
 					log.FromContext(t).Warnln("Error parsing message:", err)
-					delivery.Nack(false, false)
+					t.channel.Nack(delivery.DeliveryTag, false, false)
 					continue
 				}
-				msgChan <- msg
+
+				select {
+				case <-tomb.Dying():
+					return nil
+				case msgChan <- msg:
+				}
 			}
 		}
 	})
 	return msgChan, nil
 }
 
-func (t *AMQPTransport) consume(name string) (<-chan amqp.Delivery, error) {
-	q, err := t.channel.QueueDeclare(
-		name,  // name
-		true,  // durable
-		false, // autoDelete,
+func (t *AMQPTransport) consume(name string) (<-chan amqp.Delivery, string, error) {
+	if t.Topology.Queue(name) == nil {
+		if err := t.addQueue(name); err != nil {
+			return nil, "", err
+		}
+	}
+
+	t.muConsumers.Lock()
+	defer t.muConsumers.Unlock()
+	if _, ok := t.consumers[name]; ok {
+		return nil, "", fmt.Errorf("AMQPTransport: already consuming from %q", name)
+	}
+	t.consumerSeq++
+	tag := fmt.Sprintf("nori.%s.%d", name, t.consumerSeq)
+
+	msgs, err := t.channel.Consume(
+		name,  // queue
+		tag,   // consumer
+		false, // autoAck
 		false, // exclusive
+		false, // noLocal
 		false, // noWait
 		nil,   // args
 	)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
+	t.consumers[name] = tag
 
-	if err := t.channel.QueueBind(
-		q.Name,         // name
-		q.Name,         // key
-		t.ExchangeName, // exchange
-		false,          // noWait
-		nil,            // args
-	); err != nil {
-		return nil, err
+	return msgs, tag, nil
+}
+
+// Cancel stops consuming from the named queue. Requests already received
+// can still be acknowledged.
+func (t *AMQPTransport) Cancel(name string) error {
+	t.muConsumers.Lock()
+	tag, ok := t.consumers[name]
+	delete(t.consumers, name)
+	t.muConsumers.Unlock()
+	if !ok {
+		return fmt.Errorf("AMQPTransport: not consuming from %q", name)
 	}
 
-	msgs, err := t.channel.Consume(
-		q.Name, // queue
-		"",     // consumer
-		false,  // autoAck
-		false,  // exclusive
-		false,  // noLocal
-		false,  // noWait
-		nil,    // args
+	return t.channel.Cancel(
+		tag,   // consumer
+		false, // noWait
 	)
-	if err != nil {
-		return nil, err
-	}
+}
 
-	return msgs, nil
+func (t *AMQPTransport) consumerTag(name string) string {
+	t.muConsumers.Lock()
+	defer t.muConsumers.Unlock()
+	return t.consumers[name]
 }
 
-func (AMQPTransport) parseDelivery(d amqp.Delivery) (*message.Request, error) {
-	switch d.ContentType {
-	case "application/json":
-		// TODO refactor
-		var celeryTask protocol.CeleryTask
-		if err := json.Unmarshal(d.Body, &celeryTask); err != nil {
-			return nil, err
+// addQueue adds a durable queue bound to the exchange by its name to the
+// topology, and declares them.
+func (t *AMQPTransport) addQueue(name string) error {
+	exchange, err := t.exchange()
+	if err != nil {
+		return err
+	}
+	q, err := noriamqp.NewQueue(
+		name,  // name string
+		true,  // durable bool
+		false, // exclusive bool
+		false, // autoDelete bool
+		nil,   // args map[string]interface{}
+	)
+	if err != nil {
+		return err
+	}
+	if t.QueueType != "" {
+		q.SetType(t.QueueType)
+	}
+	if t.DeadLetterExchange != "" {
+		q.SetDeadLetter(t.DeadLetterExchange, t.DeadLetterQueue)
+	}
+	if t.MaxPriority > 0 {
+		if q.Type() == noriamqp.QueueTypeClassic {
+			q.SetMaxPriority(t.MaxPriority)
+		} else {
+			log.FromContext(t).Warnf("Priorities aren't supported by %s queue %q", q.Type(), name)
 		}
+	}
+	if t.DeliveryLimit > 0 {
+		q.SetDeliveryLimit(t.DeliveryLimit)
+	}
+	b, err := noriamqp.NewBinding(
+		q,        // dest Bindable
+		exchange, // exchange *Exchange
+		name,     // routingKey string
+		nil,      // args map[string]interface{}
+	)
+	if err != nil {
+		return err
+	}
 
-		pretty.Println("CeleryTask:", celeryTask)
+	added := noriamqp.NewTopology()
+	added.AddExchange(exchange)
+	added.AddQueue(q)
+	added.AddBinding(b)
+	if err := t.declare(added); err != nil {
+		return err
+	}
 
-		// TODO other celery fields
-		return &message.Request{
-			TaskName:  celeryTask.Name,
-			ID:        celeryTask.ID,
-			Args:      celeryTask.Args,
-			KWArgs:    celeryTask.KWArgs,
-			ETA:       celeryTask.ETA,
-			ExpiresAt: celeryTask.ExpiresAt,
-			IsUTC:     celeryTask.IsUTC,
-			ReplyTo:   &d.ReplyTo,
-		}, nil
+	if err := t.Topology.AddQueue(q); err != nil {
+		return err
+	}
+	return t.Topology.AddBinding(b)
+}
 
-	default:
-		return nil, fmt.Errorf("unsupported content type %q", d.ContentType)
+func (t *AMQPTransport) parseDelivery(d amqp.Delivery) (*message.Request, error) {
+	celeryTask, err := protocol.DecodeCeleryTask(d.ContentType, d.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// TODO other celery fields
+	celeryTask.ReplyTo = &d.ReplyTo
+	req := celeryTask.ToRequest()
+	req.Headers = noriamqp.FromTable(d.Headers)
+	req.Exchange = d.Exchange
+	req.RoutingKey = d.RoutingKey
+	req.Priority = d.Priority
+	req.Acknowledger = &amqpAcknowledger{
+		channel: t.channel,
+		tag:     d.DeliveryTag,
+	}
+	return req, nil
+}
+
+func (t *AMQPTransport) SetPrefetchCount(count int) error {
+	if t.channel == nil {
+		return errors.New("AMQPTransport: not set up")
 	}
+	return t.channel.Qos(
+		count,         // prefetchCount
+		0,             // prefetchSize
+		t.globalQoS(), // global
+	)
+}
+
+// globalQoS tells whether the prefetch count can be shared by all consumers
+// of the channel, which only classic queues support.
+func (t *AMQPTransport) globalQoS() bool {
+	return t.QueueType == "" || t.QueueType == noriamqp.QueueTypeClassic
 }
 
 func (t *AMQPTransport) Tomb() *tomb.Tomb {
@@ -166,12 +450,11 @@ func (t *AMQPTransport) Tomb() *tomb.Tomb {
 }
 
 func (t *AMQPTransport) Close() error {
-	if t.conn != nil {
-		if err := t.conn.Close(); err != nil {
-			return err
-		}
+	t.tomb.Kill(nil)
+	if t.pool != nil {
+		t.pool.Close()
 	}
-	return nil
+	return t.Factory.Close()
 }
 
 func (t *AMQPTransport) Reply(req *message.Request, resp message.Response) error {
@@ -185,11 +468,10 @@ func (t *AMQPTransport) Reply(req *message.Request, resp message.Response) error
 		return err
 	}
 
-	return t.channel.Publish(
+	return t.publish(
 		"",       // exchange
 		*replyTo, // key
 		true,     // mandatory
-		false,    // immediate
 		amqp.Publishing{
 			ContentType:   "application/json",
 			DeliveryMode:  amqp.Persistent,
@@ -199,13 +481,350 @@ func (t *AMQPTransport) Reply(req *message.Request, resp message.Response) error
 		})
 }
 
-func NewAMQPTransport(url string) Driver {
+func (t *AMQPTransport) Publish(exchange, key string, req *message.Request) error {
+	body, err := messageRequestBytes(req)
+	if err != nil {
+		return err
+	}
+
+	msg := amqp.Publishing{
+		Headers:       noriamqp.ToTable(req.Headers),
+		ContentType:   "application/json",
+		DeliveryMode:  amqp.Persistent,
+		CorrelationId: req.ID,
+		Priority:      req.Priority,
+		Timestamp:     time.Now().UTC(),
+		Body:          body,
+	}
+	if req.ReplyTo != nil {
+		msg.ReplyTo = *req.ReplyTo
+	}
+
+	return t.publish(
+		exchange, // exchange
+		key,      // key
+		false,    // mandatory
+		msg,
+	)
+}
+
+// PublishDelayed publishes a request to a queue that holds it for delay
+// rounded down to a power of two seconds, then dead-letters it to the given
+// exchange and routing key. The queue is declared on first use.
+func (t *AMQPTransport) PublishDelayed(exchange, key string, req *message.Request, delay time.Duration) error {
+	bucket := noriamqp.DelayBucket(delay)
+	if bucket == 0 {
+		return t.Publish(exchange, key, req)
+	}
+
+	q, err := noriamqp.NewDelayQueue(bucket, exchange, key)
+	if err != nil {
+		return err
+	}
+	if t.Topology.Queue(q.Name) == nil {
+		added := noriamqp.NewTopology()
+		added.AddQueue(q)
+		if err := t.declare(added); err != nil {
+			return err
+		}
+		if err := t.Topology.AddQueue(q); err != nil {
+			return err
+		}
+	}
+
+	amqpMetrics.Add("PublishDelayed", 1)
+	return t.Publish(
+		"",     // exchange
+		q.Name, // key
+		req,
+	)
+}
+
+// publish sends a message on a channel borrowed from the pool, as the
+// consuming channel must not be shared between goroutines.
+func (t *AMQPTransport) publish(exchange, key string, mandatory bool, msg amqp.Publishing) error {
+	if t.pool == nil {
+		return errors.New("AMQPTransport: not set up")
+	}
+
+	ch, err := t.pool.Get()
+	if err != nil {
+		return err
+	}
+
+	err = ch.Publish(
+		exchange,  // exchange
+		key,       // key
+		mandatory, // mandatory
+		false,     // immediate
+		msg,
+	)
+
+	switch err.(type) {
+	case nil:
+		amqpMetrics.Add("Published", 1)
+	case *noriamqp.ReturnError:
+		amqpMetrics.Add("PublishReturned", 1)
+	default:
+		switch err {
+		case noriamqp.ErrPublishNacked:
+			amqpMetrics.Add("PublishNacked", 1)
+		case noriamqp.ErrConfirmTimeout:
+			amqpMetrics.Add("PublishTimeouts", 1)
+		default:
+			amqpMetrics.Add("PublishErrors", 1)
+		}
+	}
+
+	if err == noriamqp.ErrConfirmTimeout {
+		// A late confirmation would be mistaken for the next message's
+		t.pool.Discard(ch)
+	} else {
+		t.pool.Put(ch)
+	}
+	return err
+}
+
+func (t *AMQPTransport) NotifyClose(ch chan error) chan error {
+	t.muNotify.Lock()
+	defer t.muNotify.Unlock()
+	t.closeChs = append(t.closeChs, ch)
+	return ch
+}
+
+func (t *AMQPTransport) onClose(err error) {
+	t.muNotify.Lock()
+	defer t.muNotify.Unlock()
+	for _, ch := range t.closeChs {
+		// Listeners only need to know that the connection is gone, don't
+		// block on those that haven't handled the previous notification.
+		select {
+		case ch <- err:
+		default:
+		}
+	}
+}
+
+// NewAMQPTransport returns a transport connecting to url, or an error if
+// the URL is invalid.
+func NewAMQPTransport(url string) (Driver, error) {
+	factory, err := noriamqp.NewSingleAMQPConnectionFactory(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewAMQPTransportFromFactory(factory), nil
+}
+
+// NewAMQPTransportWithConfig returns a transport connecting to url with
+// config, e.g. over TLS with a client certificate.
+func NewAMQPTransportWithConfig(url string, config *noriamqp.Config) (Driver, error) {
+	factory, err := noriamqp.NewSingleAMQPConnectionFactoryWithConfig(url, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewAMQPTransportFromFactory(factory), nil
+}
+
+func NewAMQPTransportFromFactory(factory noriamqp.ConnectionFactory) Driver {
 	return &AMQPTransport{
-		URL:          url,
+		Factory:      factory,
 		ExchangeName: "celery",
 		ExchangeKind: "direct",
-		tomb:         new(tomb.Tomb),
+		Topology:     noriamqp.NewTopology(),
+		MaxChannels:  16,
+
+		PublishTimeout: 5 * time.Second,
+
+		PublisherConfirms: true,
+		ConfirmTimeout:    5 * time.Second,
+
+		tomb: new(tomb.Tomb),
+	}
+}
+
+// declareExchange declares an exchange that raw messages are published to,
+// unless it was already.
+func (t *AMQPTransport) declareExchange(exchange Exchange) error {
+	if t.Topology.Exchange(exchange.Name) != nil {
+		return nil
+	}
+
+	e, err := noriamqp.NewExchange(
+		exchange.Kind,    // kind string
+		exchange.Name,    // name string
+		exchange.Durable, // durable bool
+		false,            // autoDelete bool
+		nil,              // args map[string]interface{}
+	)
+	if err != nil {
+		return err
+	}
+	added := noriamqp.NewTopology()
+	added.AddExchange(e)
+	if err := t.declare(added); err != nil {
+		return err
+	}
+	return t.Topology.AddExchange(e)
+}
+
+func (t *AMQPTransport) PublishRaw(exchange Exchange, key string, msg *RawMessage) error {
+	if err := t.declareExchange(exchange); err != nil {
+		return err
+	}
+
+	publishing := amqp.Publishing{
+		Headers:       noriamqp.ToTable(msg.Headers),
+		ContentType:   msg.ContentType,
+		DeliveryMode:  amqp.Transient,
+		CorrelationId: msg.CorrelationID,
+		ReplyTo:       msg.ReplyTo,
+		Timestamp:     time.Now().UTC(),
+		Body:          msg.Body,
+	}
+	if msg.Expiration > 0 {
+		publishing.Expiration = strconv.FormatInt(int64(msg.Expiration/time.Millisecond), 10)
+	}
+
+	return t.publish(
+		exchange.Name, // exchange
+		key,           // key
+		false,         // mandatory
+		publishing,
+	)
+}
+
+// Subscribe consumes from an exclusive queue bound to the exchange, on a
+// channel of its own so that the prefetch count of tasks doesn't apply.
+func (t *AMQPTransport) Subscribe(ctx context.Context, exchange Exchange, key string) (<-chan *RawMessage, error) {
+	if t.conn == nil {
+		return nil, errors.New("AMQPTransport: not set up")
+	}
+	if err := t.declareExchange(exchange); err != nil {
+		return nil, err
+	}
+
+	admin, err := noriamqp.NewAMQPAdmin(t.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer admin.Close()
+
+	q, err := admin.DeclareAnonymousQueue()
+	if err != nil {
+		return nil, err
 	}
+	e := t.Topology.Exchange(exchange.Name)
+	b, err := noriamqp.NewBinding(
+		q,   // dest Bindable
+		e,   // exchange *Exchange
+		key, // routingKey string
+		nil, // args map[string]interface{}
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := admin.DeclareBinding(b); err != nil {
+		return nil, err
+	}
+
+	ch, err := t.conn.CreateChannel()
+	if err != nil {
+		return nil, err
+	}
+	t.muConsumers.Lock()
+	t.consumerSeq++
+	tag := fmt.Sprintf("nori.subscription.%d", t.consumerSeq)
+	t.muConsumers.Unlock()
+
+	deliveryChan, err := ch.Consume(
+		q.Name, // queue
+		tag,    // consumer
+		true,   // autoAck
+		true,   // exclusive
+		false,  // noLocal
+		false,  // noWait
+		nil,    // args
+	)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	msgChan := make(chan *RawMessage)
+	tomb := t.tomb
+	tomb.Go(func() error {
+		defer close(msgChan)
+		defer ch.Close()
+		if !forwardRaw(ctx, tomb.Dying(), deliveryChan, msgChan) {
+			return nil
+		}
+
+		// Unsubscribed, the connection may be used for long still
+		if err := ch.Cancel(tag, false); err != nil {
+			log.FromContext(t).Warnln("Subscription cancel errored:", err)
+		}
+		if _, err := ch.QueueDelete(q.Name, false, false, false); err != nil {
+			log.FromContext(t).Warnln("Subscription queue deletion errored:", err)
+		}
+		return nil
+	})
+	return msgChan, nil
+}
+
+// forwardRaw passes deliveries on as raw messages until either side ends,
+// and reports whether it stopped because ctx is done.
+func forwardRaw(ctx context.Context, dying <-chan struct{}, deliveryChan <-chan amqp.Delivery, msgChan chan<- *RawMessage) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return true
+		case <-dying:
+			return false
+
+		case d, ok := <-deliveryChan:
+			if !ok {
+				return false
+			}
+			msg := &RawMessage{
+				ContentType:   d.ContentType,
+				Headers:       noriamqp.FromTable(d.Headers),
+				Body:          d.Body,
+				ReplyTo:       d.ReplyTo,
+				CorrelationID: d.CorrelationId,
+				Exchange:      d.Exchange,
+				RoutingKey:    d.RoutingKey,
+			}
+
+			select {
+			case <-ctx.Done():
+				return true
+			case <-dying:
+				return false
+			case msgChan <- msg:
+			}
+		}
+	}
+}
+
+type amqpAcknowledger struct {
+	channel noriamqp.Channel
+	tag     uint64
+}
+
+func (a *amqpAcknowledger) Ack() error {
+	return a.channel.Ack(a.tag, false)
+}
+
+func (a *amqpAcknowledger) Reject(requeue bool) error {
+	return a.channel.Reject(a.tag, requeue)
+}
+
+func messageRequestBytes(req *message.Request) ([]byte, error) {
+	p, err := protocol.NewCeleryTask(req)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(p)
 }
 
 func messageResponseBytes(resp message.Response) ([]byte, error) {
@@ -1,6 +1,9 @@
 package transport
 
 import (
+	"errors"
+	"time"
+
 	"github.com/jianyuan/nori/message"
 	"golang.org/x/net/context"
 	"gopkg.in/tomb.v2"
@@ -14,4 +17,92 @@ type Driver interface {
 	Close() error
 	Consume(string) (<-chan *message.Request, error)
 	Reply(*message.Request, message.Response) error
+
+	// Publish sends a task request to the given exchange and routing key.
+	Publish(exchange, key string, req *message.Request) error
+
+	// NotifyClose registers a listener for when the connection to the
+	// broker is lost. Consumer channels are closed at the same time.
+	NotifyClose(chan error) chan error
+}
+
+// Prefetcher is implemented by transports that can limit the number of
+// unacknowledged requests the broker sends.
+type Prefetcher interface {
+	// SetPrefetchCount sets the limit, 0 removes it.
+	SetPrefetchCount(int) error
+}
+
+// Canceller is implemented by transports that can stop consuming from a
+// queue. The channel returned by Consume is closed once the requests
+// already received were read from it.
+type Canceller interface {
+	Cancel(queue string) error
+}
+
+// QueueStats are the counts of a queue at the time it was inspected.
+type QueueStats struct {
+	Name      string `json:"name"`
+	Messages  int    `json:"messages"`
+	Consumers int    `json:"consumers"`
+}
+
+// ErrQueueNotFound is returned by a QueueInspector for a queue that doesn't
+// exist.
+var ErrQueueNotFound = errors.New("transport: Queue not found")
+
+// QueueInspector is implemented by transports that can report on and purge
+// their queues.
+type QueueInspector interface {
+	InspectQueue(name string) (*QueueStats, error)
+
+	// PurgeQueue removes the messages waiting in the queue and returns how
+	// many there were.
+	PurgeQueue(name string) (int, error)
+}
+
+// Exchange describes an exchange that raw messages are published to. It is
+// declared on first use.
+type Exchange struct {
+	Name    string
+	Kind    string
+	Durable bool
+}
+
+// RawMessage is a message outside of the task protocol, such as an event or
+// a remote control command.
+type RawMessage struct {
+	ContentType   string
+	Headers       map[string]interface{}
+	Body          []byte
+	ReplyTo       string
+	CorrelationID string
+
+	// Expiration, if set, discards the message if it isn't consumed in time
+	Expiration time.Duration
+
+	// Exchange and RoutingKey the message was published with
+	Exchange   string
+	RoutingKey string
+}
+
+// Broadcaster is implemented by transports that can publish raw messages to
+// exchanges and subscribe to them.
+type Broadcaster interface {
+	PublishRaw(exchange Exchange, key string, msg *RawMessage) error
+
+	// Subscribe binds a queue of its own to the exchange with the given
+	// binding key, and returns its messages. Once ctx is done the queue is
+	// deleted and the channel closed, which it also is when the connection
+	// to the broker is lost.
+	Subscribe(ctx context.Context, exchange Exchange, key string) (<-chan *RawMessage, error)
+}
+
+// Delayer is implemented by transports that can hold a request on the
+// broker until it is due, instead of in the memory of the consumer.
+type Delayer interface {
+	// PublishDelayed publishes a request to the given exchange and routing
+	// key once delay has passed. The request may arrive early, its ETA
+	// tells how long is left.
+	PublishDelayed(exchange, key string, req *message.Request, delay time.Duration) error
 }
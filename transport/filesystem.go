@@ -0,0 +1,345 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/jianyuan/nori/log"
+	"github.com/jianyuan/nori/message"
+	"github.com/jianyuan/nori/protocol"
+	"gopkg.in/tomb.v2"
+)
+
+// FilesystemTransport exchanges messages as files in a shared directory,
+// using the same on-disk format as kombu's filesystem transport.
+type FilesystemTransport struct {
+	context.Context
+	DataFolderIn    string
+	DataFolderOut   string
+	ProcessedFolder string
+	StoreProcessed  bool
+
+	// ErrorFolder receives the message files that can't be parsed,
+	// defaults to an "error" folder within DataFolderIn
+	ErrorFolder string
+
+	PollingInterval time.Duration
+	tomb            *tomb.Tomb
+}
+
+func (FilesystemTransport) Name() string { return "FilesystemTransport" }
+
+func (t *FilesystemTransport) Init(ctx context.Context) error {
+	t.Context = ctx
+	return nil
+}
+
+func (t *FilesystemTransport) Setup() error {
+	t.tomb.Kill(nil)
+	t.tomb = new(tomb.Tomb)
+
+	folders := []string{t.DataFolderIn, t.DataFolderOut}
+	if t.StoreProcessed {
+		if t.ProcessedFolder == "" {
+			return errors.New("FilesystemTransport: no processed folder specified")
+		}
+		folders = append(folders, t.ProcessedFolder)
+	}
+
+	for _, folder := range folders {
+		if err := os.MkdirAll(folder, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *FilesystemTransport) Consume(name string) (<-chan *message.Request, error) {
+	msgChan := make(chan *message.Request)
+	tomb := t.tomb
+	tomb.Go(func() error {
+		defer close(msgChan)
+		for {
+			req, err := t.get(name)
+			if err != nil {
+				log.FromContext(t).Warnln("Error reading message:", err)
+			}
+
+			if req == nil {
+				select {
+				case <-tomb.Dying():
+					return nil
+				case <-time.After(t.PollingInterval):
+				}
+				continue
+			}
+
+			select {
+			case <-tomb.Dying():
+				return nil
+			case msgChan <- req:
+			}
+		}
+	})
+	return msgChan, nil
+}
+
+// get claims the oldest message file for the given queue and parses it. It
+// returns nil if there is no message to consume. A file that can't be
+// parsed is moved to the error folder rather than lost.
+func (t *FilesystemTransport) get(queue string) (*message.Request, error) {
+	path, name, err := t.claimNext(queue)
+	if path == "" || err != nil {
+		return nil, err
+	}
+
+	payload, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := parseKombuPayload(payload)
+	if err != nil {
+		if moveErr := t.moveToErrorFolder(path, name); moveErr != nil {
+			return nil, fmt.Errorf("%s: %s, and moving it to the error folder errored: %s", name, err, moveErr)
+		}
+		return nil, fmt.Errorf("%s: %s, moved to the error folder", name, err)
+	}
+
+	if !t.StoreProcessed {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// claimNext claims the oldest message file for the given queue by moving it
+// out of the input folder, and returns where it was moved along with its
+// name. The path is empty if there is no message to consume.
+func (t *FilesystemTransport) claimNext(queue string) (path, name string, err error) {
+	names, err := readDirNames(t.DataFolderIn)
+	if err != nil {
+		return "", "", err
+	}
+
+	suffix := "." + queue + ".msg"
+	for _, name := range names {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+
+		path, err := t.claim(name)
+		if err == errClaimed {
+			continue
+		}
+		if err != nil {
+			return "", "", err
+		}
+		return path, name, nil
+	}
+
+	return "", "", nil
+}
+
+// moveToErrorFolder sets aside a claimed message file that can't be parsed.
+func (t *FilesystemTransport) moveToErrorFolder(path, name string) error {
+	folder := t.ErrorFolder
+	if folder == "" {
+		folder = filepath.Join(t.DataFolderIn, "error")
+	}
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return err
+	}
+	return os.Rename(path, filepath.Join(folder, name))
+}
+
+// errClaimed is returned by claim for files another consumer took first.
+var errClaimed = errors.New("FilesystemTransport: message claimed by another consumer")
+
+// claim moves a message file out of the way of other consumers while
+// holding an exclusive lock on it, so they never read the same file. Unless
+// processed messages are stored, it is renamed within the input folder, as
+// renames across filesystems fail.
+func (t *FilesystemTransport) claim(name string) (string, error) {
+	src := filepath.Join(t.DataFolderIn, name)
+	f, err := os.Open(src)
+	if os.IsNotExist(err) {
+		return "", errClaimed
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := tryLockFile(f); err != nil {
+		if isLocked(err) {
+			return "", errClaimed
+		}
+		return "", err
+	}
+	defer unlockFile(f)
+
+	dest := filepath.Join(t.ProcessedFolder, name)
+	if !t.StoreProcessed {
+		dest = fmt.Sprintf("%s.claimed.%d", src, os.Getpid())
+	}
+	if err := os.Rename(src, dest); err != nil {
+		if _, statErr := os.Stat(src); os.IsNotExist(statErr) {
+			return "", errClaimed
+		}
+		return "", err
+	}
+	return dest, nil
+}
+
+func parseKombuPayload(payload []byte) (*message.Request, error) {
+	var msg protocol.KombuMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return nil, err
+	}
+	return parseKombuMessage(&msg)
+}
+
+func parseKombuMessage(msg *protocol.KombuMessage) (*message.Request, error) {
+	body, err := msg.DecodeBody()
+	if err != nil {
+		return nil, err
+	}
+
+	celeryTask, err := protocol.DecodeCeleryTask(msg.ContentType, body)
+	if err != nil {
+		return nil, err
+	}
+
+	replyTo := msg.Properties.ReplyTo
+	celeryTask.ReplyTo = &replyTo
+	req := celeryTask.ToRequest()
+	req.Headers = msg.Headers
+	req.Exchange = msg.Properties.DeliveryInfo.Exchange
+	req.RoutingKey = msg.Properties.DeliveryInfo.RoutingKey
+	req.Priority = uint8(msg.Properties.Priority)
+	return req, nil
+}
+
+// put writes a message for the given queue into the output folder. The file
+// is written under a temporary name and renamed once complete.
+func (t *FilesystemTransport) put(queue string, msg *protocol.KombuMessage) error {
+	tag, err := message.NewID()
+	if err != nil {
+		return err
+	}
+	msg.Properties.DeliveryTag = tag
+	msg.Properties.DeliveryInfo.RoutingKey = queue
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d_%s.%s", time.Now().UnixNano()/int64(time.Millisecond), tag, queue)
+	tmp := filepath.Join(t.DataFolderOut, name+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := lockFile(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	_, err = f.Write(payload)
+	unlockFile(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(t.DataFolderOut, name+".msg"))
+}
+
+// NotifyClose never fires, there is no connection to lose.
+func (t *FilesystemTransport) NotifyClose(ch chan error) chan error {
+	return ch
+}
+
+func (t *FilesystemTransport) Tomb() *tomb.Tomb {
+	return t.tomb
+}
+
+func (t *FilesystemTransport) Close() error {
+	t.tomb.Kill(nil)
+	return nil
+}
+
+func (t *FilesystemTransport) Reply(req *message.Request, resp message.Response) error {
+	replyTo := resp.GetReplyTo()
+	if replyTo == nil || *replyTo == "" {
+		return errors.New("FilesystemTransport: no reply queue specified")
+	}
+
+	body, err := messageResponseBytes(resp)
+	if err != nil {
+		return err
+	}
+
+	msg := protocol.NewKombuMessage("application/json", body)
+	msg.Properties.CorrelationID = resp.GetID()
+	return t.put(*replyTo, msg)
+}
+
+func (t *FilesystemTransport) Publish(exchange, key string, req *message.Request) error {
+	body, err := messageRequestBytes(req)
+	if err != nil {
+		return err
+	}
+
+	msg := protocol.NewKombuMessage("application/json", body)
+	msg.Properties.CorrelationID = req.ID
+	msg.Properties.Priority = int(req.Priority)
+	if req.ReplyTo != nil {
+		msg.Properties.ReplyTo = *req.ReplyTo
+	}
+	if req.Headers != nil {
+		msg.Headers = req.Headers
+	}
+	msg.Properties.DeliveryInfo.Exchange = exchange
+	return t.put(key, msg)
+}
+
+func NewFilesystemTransport(dataFolderIn, dataFolderOut string) Driver {
+	return &FilesystemTransport{
+		DataFolderIn:    dataFolderIn,
+		DataFolderOut:   dataFolderOut,
+		PollingInterval: time.Second,
+		tomb:            new(tomb.Tomb),
+	}
+}
+
+func readDirNames(dirname string) ([]string, error) {
+	f, err := os.Open(dirname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
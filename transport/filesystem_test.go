@@ -0,0 +1,157 @@
+package transport
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jianyuan/nori/message"
+	"github.com/jianyuan/nori/protocol"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// A task message in the format written by kombu's filesystem transport.
+const kombuFilesystemMessage = `{"body": "eyJ0YXNrIjogInRhc2tzLmFkZCIsICJpZCI6ICI4ZTFjZjI3Ni1hNDgzLTRkMjItYjEyMy1jZmY2MjE4MzQ1OTIiLCAiYXJncyI6IFsxLCAyXX0=", "headers": {}, "content-type": "application/json", "properties": {"body_encoding": "base64", "delivery_info": {"priority": 0, "routing_key": "celery", "exchange": "celery"}, "delivery_mode": 2, "reply_to": "c2d3bd4e-5cd4-3ecf-a1b5-6b8e0e6a39b1", "delivery_tag": "1bfa8a9e-6b8a-4f3d-9a3b-3f2fd5a9c5d4"}, "content-encoding": "utf-8"}`
+
+func newTestFilesystemTransport(t *testing.T) (*FilesystemTransport, func()) {
+	dir, err := ioutil.TempDir("", "nori")
+	require.NoError(t, err)
+
+	tr := NewFilesystemTransport(dir, dir).(*FilesystemTransport)
+	tr.PollingInterval = 10 * time.Millisecond
+	require.NoError(t, tr.Init(context.Background()))
+	require.NoError(t, tr.Setup())
+
+	return tr, func() {
+		tr.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFilesystemTransportConsumeKombuMessage(t *testing.T) {
+	tr, cleanup := newTestFilesystemTransport(t)
+	defer cleanup()
+
+	path := filepath.Join(tr.DataFolderIn, "1000_1bfa8a9e-6b8a-4f3d-9a3b-3f2fd5a9c5d4.celery.msg")
+	require.NoError(t, ioutil.WriteFile(path, []byte(kombuFilesystemMessage), 0644))
+
+	reqChan, err := tr.Consume("celery")
+	require.NoError(t, err)
+
+	select {
+	case req := <-reqChan:
+		require.Equal(t, "tasks.add", req.TaskName)
+		require.Equal(t, "8e1cf276-a483-4d22-b123-cff621834592", req.ID)
+		require.Equal(t, []interface{}{1.0, 2.0}, req.Args)
+		require.Equal(t, "c2d3bd4e-5cd4-3ecf-a1b5-6b8e0e6a39b1", *req.ReplyTo)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+
+	names, err := readDirNames(tr.DataFolderIn)
+	require.NoError(t, err)
+	require.Empty(t, names)
+}
+
+func TestFilesystemTransportReply(t *testing.T) {
+	tr, cleanup := newTestFilesystemTransport(t)
+	defer cleanup()
+
+	req := message.NewRequest()
+	req.ID = "8e1cf276-a483-4d22-b123-cff621834592"
+	replyTo := "reply"
+	req.ReplyTo = &replyTo
+	resp := req.NewResponse()
+	resp.SetBody(3)
+
+	require.NoError(t, tr.Reply(req, resp))
+
+	path, _, err := tr.claimNext("reply")
+	require.NoError(t, err)
+	require.NotEmpty(t, path)
+	payload, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	var msg protocol.KombuMessage
+	require.NoError(t, json.Unmarshal(payload, &msg))
+	require.Equal(t, req.ID, msg.Properties.CorrelationID)
+	require.Equal(t, "reply", msg.Properties.DeliveryInfo.RoutingKey)
+
+	body, err := msg.DecodeBody()
+	require.NoError(t, err)
+	var result protocol.CeleryResult
+	require.NoError(t, json.Unmarshal(body, &result))
+	require.Equal(t, "SUCCESS", result.Status)
+	require.Equal(t, 3.0, result.Result)
+
+	path, _, err = tr.claimNext("reply")
+	require.NoError(t, err)
+	require.Empty(t, path)
+}
+
+func TestFilesystemTransportClaimErrors(t *testing.T) {
+	tr, cleanup := newTestFilesystemTransport(t)
+	defer cleanup()
+
+	name := "1000_1bfa8a9e-6b8a-4f3d-9a3b-3f2fd5a9c5d4.celery.msg"
+	_, err := tr.claim(name)
+	require.Equal(t, errClaimed, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tr.DataFolderIn, name), []byte(kombuFilesystemMessage), 0644))
+	tr.StoreProcessed = true
+	tr.ProcessedFolder = filepath.Join(tr.DataFolderIn, "missing")
+	_, err = tr.get("celery")
+	require.Error(t, err)
+	require.NotEqual(t, errClaimed, err)
+}
+
+func TestFilesystemTransportSetupStopsConsumers(t *testing.T) {
+	tr, cleanup := newTestFilesystemTransport(t)
+	defer cleanup()
+
+	reqChan, err := tr.Consume("celery")
+	require.NoError(t, err)
+	require.NoError(t, tr.Setup())
+
+	select {
+	case _, ok := <-reqChan:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("consumer of the previous setup still running")
+	}
+}
+
+func TestFilesystemTransportUnparsableMessage(t *testing.T) {
+	tr, cleanup := newTestFilesystemTransport(t)
+	defer cleanup()
+
+	bad := "1000_0a1b2c3d.celery.msg"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tr.DataFolderIn, bad), []byte("{not json"), 0644))
+	good := "1001_1bfa8a9e-6b8a-4f3d-9a3b-3f2fd5a9c5d4.celery.msg"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tr.DataFolderIn, good), []byte(kombuFilesystemMessage), 0644))
+
+	req, err := tr.get("celery")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), bad)
+	require.Nil(t, req)
+
+	// Set aside rather than lost, the next message is consumed
+	payload, err := ioutil.ReadFile(filepath.Join(tr.DataFolderIn, "error", bad))
+	require.NoError(t, err)
+	require.Equal(t, "{not json", string(payload))
+
+	req, err = tr.get("celery")
+	require.NoError(t, err)
+	require.Equal(t, "tasks.add", req.TaskName)
+
+	// Into the configured folder
+	tr.ErrorFolder = filepath.Join(tr.DataFolderIn, "failed")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tr.DataFolderIn, bad), []byte(`{"body": "%%%"}`), 0644))
+	_, err = tr.get("celery")
+	require.Error(t, err)
+	_, err = os.Stat(filepath.Join(tr.ErrorFolder, bad))
+	require.NoError(t, err)
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package transport
+
+import (
+	"os"
+	"syscall"
+)
+
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+func tryLockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// isLocked tells whether tryLockFile failed because another process holds
+// the lock.
+func isLocked(err error) bool {
+	return err == syscall.EWOULDBLOCK
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
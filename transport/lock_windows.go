@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package transport
+
+import "os"
+
+// Advisory locks are not available, consumers rely on the atomic rename
+// in FilesystemTransport.claim alone.
+
+func lockFile(f *os.File) error { return nil }
+
+func tryLockFile(f *os.File) error { return nil }
+
+func isLocked(err error) bool { return false }
+
+func unlockFile(f *os.File) error { return nil }
@@ -0,0 +1,372 @@
+package transport
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/jianyuan/nori/log"
+	"github.com/jianyuan/nori/message"
+	"github.com/jianyuan/nori/protocol"
+	"gopkg.in/tomb.v2"
+)
+
+// SQLDialect describes the differences between databases that matter to
+// SQLTransport.
+type SQLDialect struct {
+	Name string
+
+	// Placeholder returns the bind parameter for the n-th (1-based) argument.
+	Placeholder func(n int) string
+
+	// SkipLocked is set if the database supports
+	// SELECT ... FOR UPDATE SKIP LOCKED.
+	SkipLocked bool
+
+	CreateQueueTable   string
+	CreateMessageTable string
+}
+
+var PostgresDialect = &SQLDialect{
+	Name:        "postgres",
+	Placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+	SkipLocked:  true,
+	CreateQueueTable: `CREATE TABLE IF NOT EXISTS kombu_queue (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(200) UNIQUE
+	)`,
+	CreateMessageTable: `CREATE TABLE IF NOT EXISTS kombu_message (
+		id SERIAL PRIMARY KEY,
+		visible BOOLEAN,
+		timestamp TIMESTAMP,
+		payload TEXT NOT NULL,
+		version SMALLINT NOT NULL,
+		queue_id INTEGER REFERENCES kombu_queue (id)
+	)`,
+}
+
+var MySQLDialect = &SQLDialect{
+	Name:        "mysql",
+	Placeholder: func(int) string { return "?" },
+	SkipLocked:  true,
+	CreateQueueTable: `CREATE TABLE IF NOT EXISTS kombu_queue (
+		id INTEGER NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(200) UNIQUE
+	)`,
+	CreateMessageTable: `CREATE TABLE IF NOT EXISTS kombu_message (
+		id INTEGER NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		visible BOOL,
+		timestamp DATETIME,
+		payload TEXT NOT NULL,
+		version SMALLINT NOT NULL,
+		queue_id INTEGER,
+		FOREIGN KEY (queue_id) REFERENCES kombu_queue (id)
+	)`,
+}
+
+var SQLiteDialect = &SQLDialect{
+	Name:        "sqlite3",
+	Placeholder: func(int) string { return "?" },
+	CreateQueueTable: `CREATE TABLE IF NOT EXISTS kombu_queue (
+		id INTEGER NOT NULL PRIMARY KEY,
+		name VARCHAR(200) UNIQUE
+	)`,
+	CreateMessageTable: `CREATE TABLE IF NOT EXISTS kombu_message (
+		id INTEGER NOT NULL PRIMARY KEY,
+		visible BOOLEAN,
+		timestamp DATETIME,
+		payload TEXT NOT NULL,
+		version SMALLINT NOT NULL,
+		queue_id INTEGER REFERENCES kombu_queue (id)
+	)`,
+}
+
+// rebind replaces "?" bind parameters with the dialect's placeholders.
+func (d *SQLDialect) rebind(query string) string {
+	parts := strings.Split(query, "?")
+	if len(parts) == 1 {
+		return query
+	}
+	buf := make([]string, 0, len(parts)*2-1)
+	for i, part := range parts {
+		if i > 0 {
+			buf = append(buf, d.Placeholder(i))
+		}
+		buf = append(buf, part)
+	}
+	return strings.Join(buf, "")
+}
+
+// SQLTransport uses the kombu_queue and kombu_message tables of kombu's
+// SQLAlchemy transport as a broker. kombu's sent_at attribute is stored in
+// the timestamp column.
+type SQLTransport struct {
+	context.Context
+	DB              *sql.DB
+	Dialect         *SQLDialect
+	PollingInterval time.Duration
+
+	// ErrorQueue receives the messages that can't be parsed, hidden so
+	// that they are kept for inspection without being consumed. Defaults
+	// to "error".
+	ErrorQueue string
+
+	tomb *tomb.Tomb
+
+	mu       sync.Mutex
+	queueIDs map[string]int64
+}
+
+func (*SQLTransport) Name() string { return "SQLTransport" }
+
+func (t *SQLTransport) Init(ctx context.Context) error {
+	t.Context = ctx
+	return nil
+}
+
+func (t *SQLTransport) Setup() error {
+	t.tomb.Kill(nil)
+	t.tomb = new(tomb.Tomb)
+
+	if t.DB == nil {
+		return errors.New("SQLTransport: DB is nil")
+	}
+	if t.Dialect == nil {
+		return errors.New("SQLTransport: Dialect is nil")
+	}
+
+	if err := t.DB.Ping(); err != nil {
+		return err
+	}
+	if _, err := t.DB.Exec(t.Dialect.CreateQueueTable); err != nil {
+		return err
+	}
+	if _, err := t.DB.Exec(t.Dialect.CreateMessageTable); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *SQLTransport) Consume(name string) (<-chan *message.Request, error) {
+	queueID, err := t.queueID(name)
+	if err != nil {
+		return nil, err
+	}
+
+	msgChan := make(chan *message.Request)
+	tomb := t.tomb
+	tomb.Go(func() error {
+		defer close(msgChan)
+		for {
+			req, err := t.get(queueID)
+			if err != nil {
+				log.FromContext(t).Warnln("Error reading message:", err)
+			}
+
+			if req == nil {
+				select {
+				case <-tomb.Dying():
+					return nil
+				case <-time.After(t.PollingInterval):
+				}
+				continue
+			}
+
+			select {
+			case <-tomb.Dying():
+				return nil
+			case msgChan <- req:
+			}
+		}
+	})
+	return msgChan, nil
+}
+
+// queueID returns the id of the named queue, creating it if needed.
+func (t *SQLTransport) queueID(name string) (int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if id, ok := t.queueIDs[name]; ok {
+		return id, nil
+	}
+
+	query := t.Dialect.rebind("SELECT id FROM kombu_queue WHERE name = ?")
+	var id int64
+	err := t.DB.QueryRow(query, name).Scan(&id)
+	if err == sql.ErrNoRows {
+		// Another worker may create the queue at the same time, in which
+		// case the insert fails on the unique name and the select below
+		// picks up its row.
+		insert := t.Dialect.rebind("INSERT INTO kombu_queue (name) VALUES (?)")
+		if _, err := t.DB.Exec(insert, name); err != nil {
+			log.FromContext(t).Debugln("Error creating queue:", err)
+		}
+		err = t.DB.QueryRow(query, name).Scan(&id)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	t.queueIDs[name] = id
+	return id, nil
+}
+
+// get claims the oldest visible message of the queue by hiding it, and
+// parses it. It returns nil if there is no message to consume. A message
+// that can't be parsed is moved to the error queue rather than lost.
+func (t *SQLTransport) get(queueID int64) (*message.Request, error) {
+	tx, err := t.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := "SELECT id, payload FROM kombu_message WHERE queue_id = ? AND visible = ? ORDER BY timestamp, id LIMIT 1"
+	if t.Dialect.SkipLocked {
+		query += " FOR UPDATE SKIP LOCKED"
+	}
+
+	var (
+		id      int64
+		payload string
+	)
+	err = tx.QueryRow(t.Dialect.rebind(query), queueID, true).Scan(&id, &payload)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Without row locks, the visible check makes sure only one consumer
+	// gets to hide the message.
+	res, err := tx.Exec(t.Dialect.rebind("UPDATE kombu_message SET visible = ? WHERE id = ? AND visible = ?"), false, id, true)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	req, err := parseKombuPayload([]byte(payload))
+	if err != nil {
+		if moveErr := t.moveToErrorQueue(id); moveErr != nil {
+			return nil, fmt.Errorf("kombu_message %d: %s, and moving it to the error queue errored: %s", id, err, moveErr)
+		}
+		return nil, fmt.Errorf("kombu_message %d: %s, moved to the error queue", id, err)
+	}
+	return req, nil
+}
+
+// moveToErrorQueue sets aside a hidden message that can't be parsed.
+func (t *SQLTransport) moveToErrorQueue(id int64) error {
+	name := t.ErrorQueue
+	if name == "" {
+		name = "error"
+	}
+	errorQueueID, err := t.queueID(name)
+	if err != nil {
+		return err
+	}
+	_, err = t.DB.Exec(t.Dialect.rebind("UPDATE kombu_message SET queue_id = ? WHERE id = ?"), errorQueueID, id)
+	return err
+}
+
+func (t *SQLTransport) put(queue string, msg *protocol.KombuMessage) error {
+	queueID, err := t.queueID(queue)
+	if err != nil {
+		return err
+	}
+
+	tag, err := message.NewID()
+	if err != nil {
+		return err
+	}
+	msg.Properties.DeliveryTag = tag
+	msg.Properties.DeliveryInfo.RoutingKey = queue
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.DB.Exec(
+		t.Dialect.rebind("INSERT INTO kombu_message (visible, timestamp, payload, version, queue_id) VALUES (?, ?, ?, ?, ?)"),
+		true, time.Now(), string(payload), 1, queueID,
+	)
+	return err
+}
+
+// NotifyClose never fires, there is no connection to lose.
+func (t *SQLTransport) NotifyClose(ch chan error) chan error {
+	return ch
+}
+
+func (t *SQLTransport) Tomb() *tomb.Tomb {
+	return t.tomb
+}
+
+// Close stops consuming. The database handle is owned by the caller and is
+// left open.
+func (t *SQLTransport) Close() error {
+	t.tomb.Kill(nil)
+	return nil
+}
+
+func (t *SQLTransport) Reply(req *message.Request, resp message.Response) error {
+	replyTo := resp.GetReplyTo()
+	if replyTo == nil || *replyTo == "" {
+		return errors.New("SQLTransport: no reply queue specified")
+	}
+
+	body, err := messageResponseBytes(resp)
+	if err != nil {
+		return err
+	}
+
+	msg := protocol.NewKombuMessage("application/json", body)
+	msg.Properties.CorrelationID = resp.GetID()
+	return t.put(*replyTo, msg)
+}
+
+func (t *SQLTransport) Publish(exchange, key string, req *message.Request) error {
+	body, err := messageRequestBytes(req)
+	if err != nil {
+		return err
+	}
+
+	msg := protocol.NewKombuMessage("application/json", body)
+	msg.Properties.CorrelationID = req.ID
+	msg.Properties.Priority = int(req.Priority)
+	if req.ReplyTo != nil {
+		msg.Properties.ReplyTo = *req.ReplyTo
+	}
+	if req.Headers != nil {
+		msg.Headers = req.Headers
+	}
+	msg.Properties.DeliveryInfo.Exchange = exchange
+	return t.put(key, msg)
+}
+
+func NewSQLTransport(db *sql.DB, dialect *SQLDialect) Driver {
+	return &SQLTransport{
+		DB:              db,
+		Dialect:         dialect,
+		PollingInterval: time.Second,
+		tomb:            new(tomb.Tomb),
+		queueIDs:        make(map[string]int64),
+	}
+}
@@ -0,0 +1,341 @@
+package transport
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jianyuan/nori/message"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// fakeSQLDriver understands the queries of SQLTransport, and nothing else.
+type fakeSQLDriver struct {
+	mu  sync.Mutex
+	dbs map[string]*fakeSQLDB
+}
+
+var testSQLDriver = &fakeSQLDriver{dbs: make(map[string]*fakeSQLDB)}
+
+func init() {
+	sql.Register("noritest", testSQLDriver)
+}
+
+type fakeSQLDB struct {
+	mu       sync.Mutex
+	queries  []string
+	queues   map[string]int64
+	messages []*fakeSQLMessage
+	nextID   int64
+
+	// beforeHide, if set, runs before a message is hidden
+	beforeHide func(*fakeSQLMessage)
+}
+
+type fakeSQLMessage struct {
+	id        int64
+	visible   bool
+	timestamp time.Time
+	payload   string
+	queueID   int64
+}
+
+func (d *fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	db, ok := d.dbs[name]
+	if !ok {
+		db = &fakeSQLDB{queues: make(map[string]int64)}
+		d.dbs[name] = db
+	}
+	return &fakeSQLConn{db}, nil
+}
+
+type fakeSQLConn struct {
+	db *fakeSQLDB
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{db: c.db, query: query}, nil
+}
+
+func (*fakeSQLConn) Close() error { return nil }
+
+func (*fakeSQLConn) Begin() (driver.Tx, error) { return fakeSQLTx{}, nil }
+
+type fakeSQLTx struct{}
+
+func (fakeSQLTx) Commit() error { return nil }
+
+func (fakeSQLTx) Rollback() error { return nil }
+
+type fakeSQLStmt struct {
+	db    *fakeSQLDB
+	query string
+}
+
+func (*fakeSQLStmt) Close() error { return nil }
+
+func (*fakeSQLStmt) NumInput() int { return -1 }
+
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := s.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.queries = append(db.queries, s.query)
+
+	switch {
+	case strings.HasPrefix(s.query, "CREATE TABLE"):
+		return driver.RowsAffected(0), nil
+
+	case strings.HasPrefix(s.query, "INSERT INTO kombu_queue (name)"):
+		name := args[0].(string)
+		if _, ok := db.queues[name]; ok {
+			return nil, errors.New("UNIQUE constraint failed")
+		}
+		db.nextID++
+		db.queues[name] = db.nextID
+		return driver.RowsAffected(1), nil
+
+	case strings.HasPrefix(s.query, "INSERT INTO kombu_message (visible, timestamp, payload, version, queue_id)"):
+		db.nextID++
+		db.messages = append(db.messages, &fakeSQLMessage{
+			id:        db.nextID,
+			visible:   args[0].(bool),
+			timestamp: args[1].(time.Time),
+			payload:   args[2].(string),
+			queueID:   args[4].(int64),
+		})
+		return driver.RowsAffected(1), nil
+
+	case strings.HasPrefix(s.query, "UPDATE kombu_message SET queue_id"):
+		for _, m := range db.messages {
+			if m.id == args[1].(int64) {
+				m.queueID = args[0].(int64)
+				return driver.RowsAffected(1), nil
+			}
+		}
+		return driver.RowsAffected(0), nil
+
+	case strings.HasPrefix(s.query, "UPDATE kombu_message SET visible"):
+		for _, m := range db.messages {
+			if m.id != args[1].(int64) {
+				continue
+			}
+			if db.beforeHide != nil {
+				db.beforeHide(m)
+			}
+			if m.visible != args[2].(bool) {
+				return driver.RowsAffected(0), nil
+			}
+			m.visible = args[0].(bool)
+			return driver.RowsAffected(1), nil
+		}
+		return driver.RowsAffected(0), nil
+	}
+	return nil, fmt.Errorf("unexpected exec: %s", s.query)
+}
+
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := s.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.queries = append(db.queries, s.query)
+
+	switch {
+	case strings.HasPrefix(s.query, "SELECT id FROM kombu_queue WHERE name ="):
+		rows := &fakeSQLRows{columns: []string{"id"}}
+		if id, ok := db.queues[args[0].(string)]; ok {
+			rows.values = [][]driver.Value{{id}}
+		}
+		return rows, nil
+
+	case strings.HasPrefix(s.query, "SELECT id, payload FROM kombu_message") &&
+		strings.Contains(s.query, "ORDER BY timestamp, id LIMIT 1"):
+		var visible []*fakeSQLMessage
+		for _, m := range db.messages {
+			if m.queueID == args[0].(int64) && m.visible == args[1].(bool) {
+				visible = append(visible, m)
+			}
+		}
+		sort.SliceStable(visible, func(i, j int) bool {
+			if !visible[i].timestamp.Equal(visible[j].timestamp) {
+				return visible[i].timestamp.Before(visible[j].timestamp)
+			}
+			return visible[i].id < visible[j].id
+		})
+		rows := &fakeSQLRows{columns: []string{"id", "payload"}}
+		if len(visible) > 0 {
+			rows.values = [][]driver.Value{{visible[0].id, visible[0].payload}}
+		}
+		return rows, nil
+	}
+	return nil, fmt.Errorf("unexpected query: %s", s.query)
+}
+
+type fakeSQLRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string { return r.columns }
+
+func (*fakeSQLRows) Close() error { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func newTestSQLTransport(t *testing.T, dialect *SQLDialect) (*SQLTransport, *fakeSQLDB) {
+	// Start from an empty database when tests are run again
+	testSQLDriver.mu.Lock()
+	delete(testSQLDriver.dbs, t.Name()+"/"+dialect.Name)
+	testSQLDriver.mu.Unlock()
+
+	db, err := sql.Open("noritest", t.Name()+"/"+dialect.Name)
+	require.NoError(t, err)
+
+	tr := NewSQLTransport(db, dialect).(*SQLTransport)
+	require.NoError(t, tr.Init(context.Background()))
+	require.NoError(t, tr.Setup())
+
+	testSQLDriver.mu.Lock()
+	defer testSQLDriver.mu.Unlock()
+	return tr, testSQLDriver.dbs[t.Name()+"/"+dialect.Name]
+}
+
+func TestSQLDialectRebind(t *testing.T) {
+	query := "UPDATE kombu_message SET visible = ? WHERE id = ? AND visible = ?"
+	require.Equal(t, "UPDATE kombu_message SET visible = $1 WHERE id = $2 AND visible = $3", PostgresDialect.rebind(query))
+	require.Equal(t, query, MySQLDialect.rebind(query))
+	require.Equal(t, query, SQLiteDialect.rebind(query))
+	require.Equal(t, "SELECT 1", PostgresDialect.rebind("SELECT 1"))
+
+	for _, dialect := range []*SQLDialect{PostgresDialect, MySQLDialect, SQLiteDialect} {
+		// The column kombu's SQLAlchemy model maps sent_at to
+		require.Contains(t, dialect.CreateMessageTable, "timestamp ", dialect.Name)
+		require.NotContains(t, dialect.CreateMessageTable, "sent_at", dialect.Name)
+	}
+}
+
+func TestSQLTransportQueueID(t *testing.T) {
+	tr, db := newTestSQLTransport(t, SQLiteDialect)
+	defer tr.Close()
+
+	db.queues["existing"] = 42
+	id, err := tr.queueID("existing")
+	require.NoError(t, err)
+	require.Equal(t, int64(42), id)
+
+	id, err = tr.queueID("celery")
+	require.NoError(t, err)
+	require.Equal(t, db.queues["celery"], id)
+
+	// Cached from then on
+	queries := len(db.queries)
+	again, err := tr.queueID("celery")
+	require.NoError(t, err)
+	require.Equal(t, id, again)
+	require.Len(t, db.queries, queries)
+}
+
+func TestSQLTransportPutGet(t *testing.T) {
+	for _, dialect := range []*SQLDialect{PostgresDialect, MySQLDialect, SQLiteDialect} {
+		tr, db := newTestSQLTransport(t, dialect)
+		defer tr.Close()
+
+		for _, id := range []string{"first", "second", "third"} {
+			req := message.NewRequest()
+			req.TaskName = "tasks.add"
+			req.ID = id
+			require.NoError(t, tr.Publish("celery", "celery", req))
+		}
+		queueID, err := tr.queueID("celery")
+		require.NoError(t, err)
+
+		// Sent at the same time, the first inserted goes first
+		db.messages[1].timestamp = db.messages[2].timestamp
+		db.messages[0].timestamp = db.messages[2].timestamp.Add(time.Second)
+
+		var ids []string
+		for {
+			req, err := tr.get(queueID)
+			require.NoError(t, err, dialect.Name)
+			if req == nil {
+				break
+			}
+			ids = append(ids, req.ID)
+		}
+		require.Equal(t, []string{"second", "third", "first"}, ids, dialect.Name)
+		for _, m := range db.messages {
+			require.False(t, m.visible)
+		}
+	}
+}
+
+func TestSQLTransportGetClaimed(t *testing.T) {
+	tr, db := newTestSQLTransport(t, SQLiteDialect)
+	defer tr.Close()
+
+	req := message.NewRequest()
+	req.TaskName = "tasks.add"
+	require.NoError(t, tr.Publish("celery", "celery", req))
+	queueID, err := tr.queueID("celery")
+	require.NoError(t, err)
+
+	// Another consumer hides the message between the select and the update
+	db.beforeHide = func(m *fakeSQLMessage) {
+		m.visible = false
+	}
+	got, err := tr.get(queueID)
+	require.NoError(t, err)
+	require.Nil(t, got)
+}
+
+func TestSQLTransportMalformedMessage(t *testing.T) {
+	tr, db := newTestSQLTransport(t, PostgresDialect)
+	defer tr.Close()
+
+	queueID, err := tr.queueID("celery")
+	require.NoError(t, err)
+	_, err = tr.DB.Exec(
+		"INSERT INTO kombu_message (visible, timestamp, payload, version, queue_id) VALUES ($1, $2, $3, $4, $5)",
+		true, time.Now(), "{not json", 1, queueID,
+	)
+	require.NoError(t, err)
+	req := message.NewRequest()
+	req.TaskName = "tasks.add"
+	require.NoError(t, tr.Publish("celery", "celery", req))
+	malformed := db.messages[0]
+
+	got, err := tr.get(queueID)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), fmt.Sprintf("kombu_message %d", malformed.id))
+	require.Nil(t, got)
+
+	// Kept hidden in the error queue, the next message is consumed
+	require.Equal(t, db.queues["error"], malformed.queueID)
+	require.False(t, malformed.visible)
+	require.Equal(t, "{not json", malformed.payload)
+
+	got, err = tr.get(queueID)
+	require.NoError(t, err)
+	require.Equal(t, req.ID, got.ID)
+
+	got, err = tr.get(queueID)
+	require.NoError(t, err)
+	require.Nil(t, got)
+}